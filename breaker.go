@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// errBreakerOpen is returned instead of fetching while the circuit breaker is open
+var errBreakerOpen = errors.New("circuit breaker open, skipping fetch")
+
+// States of the circuit breaker
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+// type circuitBreaker stops the requests to the "segreteria digitale" after threshold consecutive failures.
+// Once open, requests are skipped for cooldown, then a single trial request is let through (half-open):
+// its success closes the breaker, its failure opens it again.
+// A threshold of 0 disables the breaker
+type circuitBreaker struct {
+	mu sync.Mutex
+	// siteUrl is the school whose requests are stopped, used in the logs
+	siteUrl   string
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	state     string
+	openedAt  time.Time
+	// trial is true while the half-open trial request is running
+	trial bool
+}
+
+func newCircuitBreaker(siteUrl string, threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{siteUrl: siteUrl, threshold: threshold, cooldown: cooldown, state: breakerClosed}
+}
+
+// allow reports whether a request can be made now
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		log.Printf("INFO: circuit breaker of %s half-open, testing recovery", b.siteUrl)
+		b.state = breakerHalfOpen
+		b.trial = true
+		return true
+	case breakerHalfOpen:
+		// Only the trial request goes through
+		if b.trial {
+			return false
+		}
+		b.trial = true
+		return true
+	}
+	return true
+}
+
+// success records a successful request, closing the breaker
+func (b *circuitBreaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state != breakerClosed {
+		log.Printf("INFO: circuit breaker of %s closed", b.siteUrl)
+	}
+	b.state = breakerClosed
+	b.failures = 0
+	b.trial = false
+}
+
+// failure records a failed request, opening the breaker after threshold consecutive ones or a failed trial
+func (b *circuitBreaker) failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	b.trial = false
+	if b.threshold > 0 && (b.state == breakerHalfOpen || b.failures >= b.threshold) {
+		if b.state != breakerOpen {
+			log.Printf("WARNING: circuit breaker of %s open after %d consecutive failures, pausing requests for %v", b.siteUrl, b.failures, b.cooldown)
+		}
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// currentState returns the state of the breaker
+func (b *circuitBreaker) currentState() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// type breakerSet has a circuit breaker for each school, so a failing site doesn't stop the fetches of the others.
+// It's filled at startup and never changed, so it's read without locking
+type breakerSet map[string]*circuitBreaker
+
+func newBreakerSet(siteUrls []string, threshold int, cooldown time.Duration) breakerSet {
+	breakers := make(breakerSet, len(siteUrls))
+	for _, siteUrl := range siteUrls {
+		breakers[siteUrl] = newCircuitBreaker(siteUrl, threshold, cooldown)
+	}
+	return breakers
+}
+
+// states returns the state of the breaker of each school
+func (s breakerSet) states() map[string]string {
+	states := make(map[string]string, len(s))
+	for siteUrl, b := range s {
+		states[siteUrl] = b.currentState()
+	}
+	return states
+}
+
+// worstState returns open when any breaker is open, otherwise half-open when any is half-open, otherwise closed
+func (s breakerSet) worstState() string {
+	worst := breakerClosed
+	for _, b := range s {
+		switch b.currentState() {
+		case breakerOpen:
+			return breakerOpen
+		case breakerHalfOpen:
+			worst = breakerHalfOpen
+		}
+	}
+	return worst
+}
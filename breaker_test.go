@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBreakerSetIsolatesSchools(t *testing.T) {
+	failing, other := "https://a.example/comunicati.php", "https://b.example/comunicati.php"
+	breakers := newBreakerSet([]string{failing, other}, 2, time.Hour)
+	for i := 0; i < 2; i++ {
+		if !breakers[failing].allow() {
+			t.Fatalf("request %d not allowed before the threshold", i+1)
+		}
+		breakers[failing].failure()
+	}
+
+	if breakers[failing].allow() {
+		t.Error("the failing school is still fetched after the threshold")
+	}
+	if !breakers[other].allow() {
+		t.Error("the other school isn't fetched")
+	}
+	if got := breakers.states(); got[failing] != breakerOpen || got[other] != breakerClosed {
+		t.Errorf("states are %v, expected %s open and %s closed", got, failing, other)
+	}
+	if got := breakers.worstState(); got != breakerOpen {
+		t.Errorf("worst state is %s, expected %s", got, breakerOpen)
+	}
+}
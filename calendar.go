@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// icsEscaper escapes the TEXT values of the iCalendar properties, RFC 5545 section 3.3.11
+var icsEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`)
+
+// icsLine returns the content line, folded so no line is longer than 75 octets without breaking a UTF-8 sequence
+func icsLine(line string) string {
+	var b strings.Builder
+	n := 0
+	for _, r := range line {
+		size := len(string(r))
+		if n+size > 75 {
+			// The continuation lines start with a space, that counts towards their length
+			b.WriteString("\r\n ")
+			n = 1
+		}
+		b.WriteRune(r)
+		n += size
+	}
+	b.WriteString("\r\n")
+	return b.String()
+}
+
+// circularEvent returns the all day dates of the event of the circular, from the published date through the valid until one.
+// A circular with only one of them, or valid until before its publication, gets a single day event.
+// ok is false when the circular has no date at all
+func circularEvent(c latestCircular) (start, end time.Time, ok bool) {
+	published, errPublished := time.Parse("2006-01-02", c.PublishedDate)
+	validUntil, errValidUntil := time.Parse("2006-01-02", c.ValidUntil)
+	switch {
+	case errPublished == nil && errValidUntil == nil && !validUntil.Before(published):
+		start, end = published, validUntil
+	case errPublished == nil:
+		start, end = published, published
+	case errValidUntil == nil:
+		start, end = validUntil, validUntil
+	default:
+		return time.Time{}, time.Time{}, false
+	}
+	// DTEND of an all day event is exclusive
+	return start, end.AddDate(0, 0, 1), true
+}
+
+// writeCalendar writes the circulars as an iCalendar feed, an all day event per circular. See circularEvent
+func writeCalendar(w io.Writer, circulars []latestCircular, now time.Time) error {
+	var b strings.Builder
+	b.WriteString(icsLine("BEGIN:VCALENDAR"))
+	b.WriteString(icsLine("VERSION:2.0"))
+	b.WriteString(icsLine("PRODID:-//SpaggiariCircularsParser//Circolari//IT"))
+	b.WriteString(icsLine("CALSCALE:GREGORIAN"))
+	b.WriteString(icsLine("X-WR-CALNAME:Circolari"))
+	stamp := now.UTC().Format("20060102T150405Z")
+	for _, c := range circulars {
+		start, end, ok := circularEvent(c)
+		if !ok {
+			continue
+		}
+		b.WriteString(icsLine("BEGIN:VEVENT"))
+		b.WriteString(icsLine(fmt.Sprintf("UID:circolare-%d@spaggiari", c.Id)))
+		b.WriteString(icsLine("DTSTAMP:" + stamp))
+		b.WriteString(icsLine("DTSTART;VALUE=DATE:" + start.Format("20060102")))
+		b.WriteString(icsLine("DTEND;VALUE=DATE:" + end.Format("20060102")))
+		b.WriteString(icsLine("SUMMARY:" + icsEscaper.Replace(c.Title)))
+		if c.Category != "" {
+			b.WriteString(icsLine("CATEGORIES:" + icsEscaper.Replace(c.Category)))
+		}
+		if c.Url != "" {
+			b.WriteString(icsLine("URL:" + c.Url))
+		}
+		b.WriteString(icsLine("END:VEVENT"))
+	}
+	b.WriteString(icsLine("END:VCALENDAR"))
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+)
+
+// defaultChangesLimit is the max number of circulars returned by /circulars/changes
+const defaultChangesLimit = 500
+
+// dbTimeLayout is the layout of the DATETIME values read from the DB
+const dbTimeLayout = "2006-01-02 15:04:05"
+
+// type circularChange is a circular added or changed after a given time
+type circularChange struct {
+	Id       uint64 `json:"id"`
+	Title    string `json:"title"`
+	Category string `json:"category"`
+	// PublishedDate is yyyy-mm-dd, empty when unknown
+	PublishedDate string `json:"published_date"`
+	Url           string `json:"url"`
+	AddedAt       string `json:"added_at"`
+	// ChangedAt is when the circular has been added or last changed. The next request passes the last one as since,
+	// with its id as after_id, as a whole cycle shares the same ChangedAt
+	ChangedAt string `json:"changed_at"`
+	// Deleted is true when the circular has been hidden by an operator, only its id and ChangedAt are returned
+	Deleted bool `json:"deleted"`
+}
+
+// formatDBTime returns the stored UTC time as RFC3339, the raw value when it can't be parsed
+func formatDBTime(s sql.NullString) string {
+	if t, err := time.Parse(dbTimeLayout, s.String); err == nil {
+		return t.Format(time.RFC3339)
+	}
+	return s.String
+}
+
+// queryChanges returns the circulars changed after the (since, afterId) cursor, the oldest changes first:
+// the ones changed after since and the ones changed at since with an id greater than afterId.
+// The circulars of a cycle share the same second, so since alone would skip the ones past the limit.
+// Circulars stored before the update time was tracked only count as added. The ones hidden by an operator are returned
+// without their values, so the clients remove them, and a restored one is returned again in full
+func queryChanges(db *sql.DB, since time.Time, afterId uint64, limit int) ([]circularChange, error) {
+	col := columns
+	changed := "COALESCE(`" + col.updatedAt + "`, `" + col.addedAt + "`)"
+	sinceArg := since.UTC().Format(dbTimeLayout)
+	rows, err := db.Query(
+		"SELECT `"+col.id+"` id, `"+col.title+"`, `"+col.category+"`, `"+col.publishedDate+"`, `"+col.url+"`, `"+col.addedAt+"`, "+changed+" changed, `"+col.deletedAt+"` IS NOT NULL "+
+			"FROM circolare WHERE ("+changed+" > ? OR ("+changed+" = ? AND `"+col.id+"` > ?)) ORDER BY changed, id LIMIT ?",
+		sinceArg,
+		sinceArg,
+		afterId,
+		limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	changes := []circularChange{}
+	for rows.Next() {
+		var c circularChange
+		var published, u, added, changedAt sql.NullString
+		if err := rows.Scan(&c.Id, &c.Title, &c.Category, &published, &u, &added, &changedAt, &c.Deleted); err != nil {
+			return nil, err
+		}
+		c.ChangedAt = formatDBTime(changedAt)
+		if c.Deleted {
+			changes = append(changes, circularChange{Id: c.Id, ChangedAt: c.ChangedAt, Deleted: true})
+			continue
+		}
+		c.PublishedDate, c.Url, c.AddedAt = published.String, u.String, formatDBTime(added)
+		changes = append(changes, c)
+	}
+	return changes, rows.Err()
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQueryChangesSameSecond(t *testing.T) {
+	db := openTestDB(t)
+	if err := migrateDB(db, dbDriver, defaultColumns()); err != nil {
+		t.Fatal(err)
+	}
+
+	// A whole cycle is stored in the same second, more rows than a page
+	const stored, limit = 7, 3
+	changedAt := time.Date(2024, time.January, 10, 8, 0, 0, 0, time.UTC)
+	for id := 1; id <= stored; id++ {
+		if _, err := db.Exec("INSERT INTO `circolare` (`id`, `titolo`, `categoria`, `aggiunta_il`) VALUES (?, 'Titolo', 'Categoria', ?)", id, changedAt.Format(dbTimeLayout)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	since, afterId := changedAt.Add(-time.Hour), uint64(0)
+	seen := make(map[uint64]int)
+	for page := 0; page <= stored; page++ {
+		changes, err := queryChanges(db, since, afterId, limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(changes) == 0 {
+			break
+		}
+		for _, c := range changes {
+			seen[c.Id]++
+		}
+		last := changes[len(changes)-1]
+		if since, err = time.Parse(time.RFC3339, last.ChangedAt); err != nil {
+			t.Fatal(err)
+		}
+		afterId = last.Id
+	}
+	for id := uint64(1); id <= stored; id++ {
+		if seen[id] != 1 {
+			t.Errorf("circular %d returned %d times, expected once", id, seen[id])
+		}
+	}
+}
+
+func TestQueryChangesHidden(t *testing.T) {
+	db := openTestDB(t)
+	if err := migrateDB(db, dbDriver, defaultColumns()); err != nil {
+		t.Fatal(err)
+	}
+	added := time.Now().UTC().Add(-time.Hour)
+	if _, err := db.Exec("INSERT INTO `circolare` (`id`, `titolo`, `categoria`, `aggiunta_il`) VALUES (1, 'Titolo', 'Categoria', ?)", added.Format(dbTimeLayout)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each change is after the previous one, the same second would be skipped by the cursor
+	since := added
+	for _, deleted := range []bool{true, false} {
+		time.Sleep(time.Second)
+		if err := setDeleted(db, 1, deleted); err != nil {
+			t.Fatal(err)
+		}
+		changes, err := queryChanges(db, since, 1, defaultChangesLimit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(changes) != 1 || changes[0].Deleted != deleted || (changes[0].Title == "") != deleted {
+			t.Fatalf("got changes %+v after setting deleted to %t", changes, deleted)
+		}
+		if since, err = time.Parse(time.RFC3339, changes[0].ChangedAt); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
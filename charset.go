@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"mime"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// metaCharsetPattern finds the charset declared by the html meta tags, both <meta charset="..."> and
+// <meta http-equiv="Content-Type" content="text/html; charset=...">
+var metaCharsetPattern = regexp.MustCompile(`(?i)<meta[^>]+charset\s*=\s*["']?\s*([\w-]+)`)
+
+// metaSniffBytes is how much of the body is searched for the meta tags, as browsers do
+const metaSniffBytes = 1024
+
+// charsetAliases are the other names of the supported charsets, besides the iso8859-N and cpNNNN spellings
+var charsetAliases = map[string]string{
+	"utf8":     "utf-8",
+	"us-ascii": "utf-8",
+	"ascii":    "utf-8",
+	// Browsers decode ISO-8859-1 as windows-1252 too, its extra chars are control chars in ISO-8859-1
+	"iso-8859-1": "windows-1252",
+	"latin1":     "windows-1252",
+	"l1":         "windows-1252",
+	"cp819":      "windows-1252",
+	"latin2":     "iso-8859-2",
+	"l2":         "iso-8859-2",
+	"latin3":     "iso-8859-3",
+	"l3":         "iso-8859-3",
+	"latin4":     "iso-8859-4",
+	"l4":         "iso-8859-4",
+	"cyrillic":   "iso-8859-5",
+	"arabic":     "iso-8859-6",
+	"greek":      "iso-8859-7",
+	"hebrew":     "iso-8859-8",
+	"latin5":     "iso-8859-9",
+	"l5":         "iso-8859-9",
+	"latin6":     "iso-8859-10",
+	"l6":         "iso-8859-10",
+	"latin7":     "iso-8859-13",
+	"l7":         "iso-8859-13",
+	"latin8":     "iso-8859-14",
+	"l8":         "iso-8859-14",
+	"latin9":     "iso-8859-15",
+	"l9":         "iso-8859-15",
+	"latin10":    "iso-8859-16",
+	"l10":        "iso-8859-16",
+}
+
+// isoCharsetPattern and windowsCharsetPattern match the spellings of the ISO-8859-N and windows-125N charsets
+var (
+	isoCharsetPattern     = regexp.MustCompile(`^iso[-_]?8859[-_](\d+)$`)
+	windowsCharsetPattern = regexp.MustCompile(`^(?:windows-|x-cp|cp)(125\d)$`)
+)
+
+// singleByteRunes are the decoding tables of singleByteCharsets, indexed by the byte minus 0x80
+var singleByteRunes = func() map[string][]rune {
+	tables := make(map[string][]rune, len(singleByteCharsets))
+	for charset, runes := range singleByteCharsets {
+		tables[charset] = []rune(runes)
+	}
+	return tables
+}()
+
+// normalizeCharset returns the canonical name of the charset, as used by singleByteCharsets
+func normalizeCharset(charset string) string {
+	charset = strings.ToLower(strings.TrimSpace(charset))
+	if m := isoCharsetPattern.FindStringSubmatch(charset); m != nil {
+		charset = "iso-8859-" + m[1]
+	} else if m := windowsCharsetPattern.FindStringSubmatch(charset); m != nil {
+		charset = "windows-" + m[1]
+	}
+	if alias, ok := charsetAliases[charset]; ok {
+		return alias
+	}
+	return charset
+}
+
+// detectCharset returns the lower case charset of the body, from the Content-Type header or else from the meta tags.
+// Returns "utf-8" when none is declared
+func detectCharset(contentType string, body []byte) string {
+	if _, params, err := mime.ParseMediaType(contentType); err == nil && params["charset"] != "" {
+		return strings.ToLower(params["charset"])
+	}
+	head := body
+	if len(head) > metaSniffBytes {
+		head = head[:metaSniffBytes]
+	}
+	if m := metaCharsetPattern.FindSubmatch(head); m != nil {
+		return strings.ToLower(string(m[1]))
+	}
+	return "utf-8"
+}
+
+// toUTF8 transcodes body from charset to UTF-8.
+// Besides UTF-8, the single byte charsets of the ISO-8859 and windows-125x families are supported
+func toUTF8(body []byte, charset string) ([]byte, error) {
+	charset = normalizeCharset(charset)
+	if charset == "utf-8" {
+		return body, nil
+	}
+	runes, ok := singleByteRunes[charset]
+	if !ok {
+		return nil, fmt.Errorf("unsupported charset %q", charset)
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(len(body) + len(body)/8)
+	for _, b := range body {
+		if b < utf8.RuneSelf {
+			buf.WriteByte(b)
+		} else {
+			buf.WriteRune(runes[b-0x80])
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeCharset transcodes the response body to UTF-8 using its declared charset.
+// An unsupported charset is only logged, the body is parsed as it is
+func decodeCharset(contentType string, body []byte) []byte {
+	charset := detectCharset(contentType, body)
+	decoded, err := toUTF8(body, charset)
+	if err != nil {
+		log.Printf("WARNING: %v, parsing the response as UTF-8", err)
+		return body
+	}
+	return decoded
+}
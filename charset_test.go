@@ -0,0 +1,83 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDetectCharset(t *testing.T) {
+	tests := []struct {
+		name, contentType, body, expected string
+	}{
+		{"header", "text/html; charset=ISO-8859-15", "<html></html>", "iso-8859-15"},
+		{"quoted header", `text/html; charset="windows-1250"`, "<html></html>", "windows-1250"},
+		{"header before meta", "text/html; charset=utf-8", `<meta charset="iso-8859-1">`, "utf-8"},
+		{"meta charset", "text/html", `<html><head><meta charset="ISO-8859-2"></head>`, "iso-8859-2"},
+		{"unquoted meta charset", "", `<meta charset=windows-1252>`, "windows-1252"},
+		{"meta http-equiv", "text/html", `<meta http-equiv="Content-Type" content="text/html; charset=iso-8859-1">`, "iso-8859-1"},
+		{"meta after the sniffed bytes", "", strings.Repeat(" ", metaSniffBytes) + `<meta charset="iso-8859-1">`, "utf-8"},
+		{"undeclared", "", "<html></html>", "utf-8"},
+		{"invalid header", "text/html; charset", `<meta charset="latin1">`, "latin1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := detectCharset(tt.contentType, []byte(tt.body)); got != tt.expected {
+				t.Errorf("got %q, expected %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestToUTF8(t *testing.T) {
+	tests := []struct {
+		charset  string
+		body     []byte
+		expected string
+	}{
+		{"utf-8", []byte("perché"), "perché"},
+		{"US-ASCII", []byte("Circolare"), "Circolare"},
+		// ISO-8859-1 is decoded as windows-1252
+		{"iso-8859-1", []byte{'p', 'e', 'r', 'c', 'h', 0xE9, ' ', 0x80}, "perché €"},
+		{"latin1", []byte{0xE0}, "à"},
+		{"cp1252", []byte{0x93, 'x', 0x94}, "“x”"},
+		{"windows-1252", []byte{0x81}, "�"},
+		{"ISO-8859-15", []byte{0xA4, 0xBD}, "€œ"},
+		{"iso_8859-2", []byte{0xA3, 0xF3, 0xB3}, "Łół"},
+		{"latin2", []byte{0xA9}, "Š"},
+		{"windows-1250", []byte{0x8A, 0xE8}, "Šč"},
+		{"x-cp1251", []byte{0xCF, 0xF0, 0xE8}, "При"},
+		{"iso-8859-7", []byte{0xE1, 0xE2}, "αβ"},
+		{"windows-1253", []byte{0xAA}, "�"},
+	}
+	for _, tt := range tests {
+		got, err := toUTF8(tt.body, tt.charset)
+		if err != nil || string(got) != tt.expected {
+			t.Errorf("%s: got %q, %v, expected %q", tt.charset, got, err, tt.expected)
+		}
+	}
+
+	for _, charset := range []string{"utf-16", "shift_jis", "iso-8859-12", "windows-1260"} {
+		if _, err := toUTF8([]byte("x"), charset); err == nil {
+			t.Errorf("%s: decoded, expected an unsupported charset", charset)
+		}
+	}
+}
+
+func TestSingleByteCharsets(t *testing.T) {
+	for charset, runes := range singleByteRunes {
+		if len(runes) != 0x80 {
+			t.Errorf("%s has %d runes, expected %d", charset, len(runes), 0x80)
+		}
+	}
+}
+
+func TestDecodeCharset(t *testing.T) {
+	body := []byte("<meta charset=\"iso-8859-15\"><p>\xA4 5</p>")
+	if got := string(decodeCharset("text/html", body)); got != "<meta charset=\"iso-8859-15\"><p>€ 5</p>" {
+		t.Errorf("got %q from the meta charset", got)
+	}
+	// An unsupported charset leaves the body as it is
+	if got := decodeCharset("text/html; charset=utf-16", body); string(got) != string(body) {
+		t.Errorf("got %q, expected the body unchanged", got)
+	}
+}
@@ -1,24 +1,129 @@
 // package main contains the Main function where everything happens.
 // The following ENV variables are required.
 // CIRCULARS_DB_CONNECTION_STRING=db_user:db_pass@tcp(db_host:db_port)/db_name
-// CIRCULARS_SITE_URL=https://web.spaggiari.eu/sdg/app/default/comunicati.php?sede_codice=XXXX0000
-// CIRCULARS_CYCLE_WAIT=5m
+//
+//	or CIRCULARS_DB_CONNECTION_STRING_FILE=/run/secrets/db -> file containing the connection string, takes precedence
+//
+// CIRCULARS_SITE_URL=https://web.spaggiari.eu/sdg/app/default/comunicati.php?sede_codice=XXXX0000 -> comma separated for more schools
+// CIRCULARS_CYCLE_WAIT=5m -> not required when CIRCULARS_CRON is set
+// The following ENV variables are optional.
+// CIRCULARS_CRON="*/15 7-18 * * 1-5" -> cron schedule of the work cycles, in the local time zone
+// CIRCULARS_CYCLE_TIMEOUT=5m -> cancel a cycle running longer than this, CIRCULARS_CYCLE_WAIT by default. 0 for no deadline
+// CIRCULARS_PROFILES_FILE=profiles.json -> named sets of these variables, see profilesConfig
+// CIRCULARS_PROFILE=staging -> profile of CIRCULARS_PROFILES_FILE to use, the variables set in the environment override it
+// CIRCULARS_SKIP_INITIAL_RUN=true -> wait for the first interval, or cron match, instead of starting a cycle at once
+// CIRCULARS_HTTP_ADDR=:8080 -> address of the HTTP server exposing the endpoints
+// CIRCULARS_HTTP_TOKEN=secret -> token required by the endpoints, mandatory when the HTTP server is enabled
+// CIRCULARS_ADMIN_TOKEN=secret -> token of the endpoints hiding and showing again a circular, they're disabled when it's not set
+// CIRCULARS_FULLTEXT=true -> create a FULLTEXT index on the titles and use it for /search
+// CIRCULARS_STATS_TTL=30s -> how long the /stats result is cached
+// CIRCULARS_VALID_UNTIL=inclusive -> a circular is valid through its "valid until" day, or exclusive for only up to its start. Used by /circulars/active
+// CIRCULARS_REFRESH_SHARED=false -> run a cycle for each /refresh request, instead of sharing the one in flight
+// CIRCULARS_PROXY_ATTACHMENTS=true -> serve the stored attachments on /attachments/{id}, fetched from the "segreteria digitale"
+// CIRCULARS_CACHE_SIZE=200 -> most recent circulars kept in memory for /circulars and /feed, 0 to always read the DB
+// CIRCULARS_LOCALE=it -> language of the dates and labels shown by the "segreteria digitale"
+// CIRCULARS_MIN_DATE=01/09/2023 -> ignore circulars published before this date, they're neither inserted nor deleted during cleanup
+// CIRCULARS_MAX_DATE=31/08/2024 -> ignore circulars published after this date, they're neither inserted nor deleted during cleanup
+// CIRCULARS_ID_REUSE_THRESHOLD=0.2 -> warn when an update has a title less similar than this, from 0 to 1, and another published date. 0 disables it
+// CIRCULARS_ID_REUSE_KEEP_STORED=true -> keep the stored circular instead of overwriting it, when the id looks reused
+// CIRCULARS_MIN_ID=12000 -> ignore circulars with a smaller id, they're neither inserted nor deleted during cleanup
+// CIRCULARS_NORMALIZE_WHITESPACE=true -> collapse repeated whitespace in titles and categories
+// CIRCULARS_DUPLICATE_THRESHOLD=0.8 -> title similarity, from 0 to 1, from which two circulars of a category are linked in circolare_duplicata
+// CIRCULARS_DUPLICATE_WINDOW=168h -> how far apart the published dates of two duplicates can be
+// CIRCULARS_CATEGORIES=Generale,Didattica -> handle only circulars of these categories
+// CIRCULARS_CATEGORY_MAP=didattica=Didattica,comunicazioni=Generale -> canonical name of each category, compared case insensitively
+// CIRCULARS_CATEGORY_TITLE_CASE=true -> title case the categories missing from CIRCULARS_CATEGORY_MAP, otherwise they're kept as they are
+// CIRCULARS_PARSE_STRICTNESS=strict -> skip circulars with a missing label, or lenient to fall back to the span positions
+// CIRCULARS_COLLECT_EXTRA=true -> store as JSON all the labeled fields of the circulars
+// CIRCULARS_STORE_RAW_HTML=true -> store the gzipped html of each row in circolare_html, to parse it again later
+// CIRCULARS_STORE_REJECTED=false -> don't record in circolare_scartata the circulars skipped while parsing
+// CIRCULARS_SCHOOL_YEAR_START_MONTH=9 -> first month of the school year, used for the school year of the circulars
+// CIRCULARS_MERGE_DUPLICATE_ATTACHMENTS=false -> merge the attachments repeated with the same id in a circular into the first one
+// CIRCULARS_MAX_ATTACHMENT_TITLE_LENGTH=255 -> longer attachments titles are truncated, 0 for no limit
+// CIRCULARS_MAX_TITLE_LENGTH=255 -> longer titles are truncated, set it to the VARCHAR size of circolare.titolo. 0 for no limit
+// CIRCULARS_MAX_CATEGORY_LENGTH=255 -> longer categories are truncated, set it to the VARCHAR size of circolare.categoria. 0 for no limit
+// CIRCULARS_HTTP_MAX_IDLE_CONNS=10 -> idle connections kept alive towards the "segreteria digitale"
+// CIRCULARS_HTTP_IDLE_CONN_TIMEOUT=90s -> how long an idle connection is kept alive
+// CIRCULARS_HTTP_TLS_HANDSHAKE_TIMEOUT=10s -> max wait for the TLS handshake
+// CIRCULARS_TLS_MIN_VERSION=1.2 -> min TLS version of the HTTP requests and of the DB connection, when the connection string enables TLS
+// CIRCULARS_TLS_INSECURE_SKIP_VERIFY=true -> don't verify the certificates of the HTTP and DB connections, only for self-signed certificates
+// CIRCULARS_CONCURRENCY=4 -> max number of schools processed in parallel
+// CIRCULARS_MAX_RESPONSE_BYTES=67108864 -> max size of a single decompressed response
+// CIRCULARS_ERROR_SNIPPET_BYTES=200 -> how much of the body of a non-2xx response is shown in its error, 0 for none
+// CIRCULARS_INSERT_STRATEGY=upsert-recent-25 -> which stored circulars get updated: ignore-all, upsert-all, upsert-recent-N, upsert-since-dd/mm/yyyy
+// CIRCULARS_FETCH_MODE=post -> post to the search endpoint, or get the server rendered page
+// CIRCULARS_SEARCH_ACTION=akSEARCH -> action of the search request
+// CIRCULARS_SEARCH_FIELD=default -> field of the search request
+// CIRCULARS_TABLE_WRAP=auto -> wrap the fragments of the search response in a table: auto when they don't have one, always or never
+// CIRCULARS_DEBUG_CAPTURE_DIR=captures -> save every raw response body in this directory, for debugging
+// CIRCULARS_DISABLE_DELETE=true -> never remove from the DB the circulars deleted from the website
+// CIRCULARS_CLEANUP_ON_START=true -> run the cleanup in the first cycle, by default it's deferred by cleanupInterval (6h) from the startup,
+// so a freshly populated or partially migrated DB isn't cleaned up at once. The later cleanups run every cleanupInterval anyway
+// CIRCULARS_CLEANUP_RESYNC=true -> also update every stored circular during cleanup, whatever the insert strategy
+// CIRCULARS_CLEANUP_ON_INSERT_FAILURE=true -> run the cleanup when the insert failed but the parse was complete, a failed fetch or parse still skips it. See runCycle
+// CIRCULARS_MAX_DELETE_PERCENT=20 -> refuse a cleanup removing more than this percent of the stored circulars in scope, 0 for no limit
+// CIRCULARS_DELETE_GRACE=6h -> how long a circular must be missing from the website before it's removed, 0 to remove it at once
+// CIRCULARS_CLEANUP_SCOPE=all -> stored circulars compared during cleanup: all, fetched (id window of the parsed ones), recent-Nd
+// CIRCULARS_DOWNLOAD_DIR=attachments -> download the attachments in this directory
+// CIRCULARS_DOWNLOAD_PATH={year}/{circular_id}/{attachment_id}_{title} -> path template of the downloaded attachments, see downloader
+// CIRCULARS_DOWNLOAD_CONCURRENCY=2 -> max number of attachments downloaded in parallel, across all the schools
+// CIRCULARS_DOWNLOAD_MAX_PER_CIRCULAR=1 -> download only the first attachments of each circular, the others are still stored. 0 for all
+// CIRCULARS_QUEUE_DIR=queue -> keep in this directory the circulars whose insert failed, they're inserted by the next cycles
+// CIRCULARS_QUEUE_MAX_BATCHES=100 -> how many failed inserts are kept in CIRCULARS_QUEUE_DIR, the oldest are dropped
+// CIRCULARS_PROBE_ATTACHMENTS=true -> store the type and size of the attachments, got with a HEAD request without downloading them
+// CIRCULARS_PROBE_CONCURRENCY=4 -> max number of attachments probed in parallel, across all the schools
+// CIRCULARS_BREAKER_THRESHOLD=5 -> consecutive fetch failures of a school that stop fetching it for a while, 0 to never stop
+// CIRCULARS_BREAKER_COOLDOWN=10m -> how long fetching stops
+// CIRCULARS_LOG_FILE=circolari.log -> write logs to this file instead of stderr
+// CIRCULARS_LOG_MAX_SIZE=10485760 -> size in bytes after which the log file is rotated
+// CIRCULARS_LOG_MAX_BACKUPS=5 -> number of rotated log files kept
+// CIRCULARS_COLUMN_MAP=title=oggetto,published_date=pubblicazione -> names of the columns that differ from the default ones, see columnMapping.list
+// CIRCULARS_SHUTDOWN_TIMEOUT=30s -> on SIGINT/SIGTERM wait this long for the running cycle, then force the exit. 0 to wait for it
+// CIRCULARS_MAX_CONSECUTIVE_FAILURES=3 -> exit with an error after this many failed cycles in a row, 0 to never exit
+// CIRCULARS_MIGRATE=false -> don't create nor upgrade the tables at startup, see migrateDB
+// CIRCULARS_DB_READ_CONNECTION_STRING=db_user:db_pass@tcp(replica_host:db_port)/db_name -> read replica queried by the HTTP endpoints, the cycles write to the primary
+// CIRCULARS_DB_STARTUP_TIMEOUT=1m -> how long to wait for the DB at startup
+// CIRCULARS_DB_MAX_IDLE_TIME=5m -> idle DB connections are closed after this, keep it below MySQL's wait_timeout
+// CIRCULARS_DB_PING_INTERVAL=1m -> ping the DB between cycles, discarding the dead connections
+// CIRCULARS_WEBHOOK_URL=https://hooks.example/circulars -> receives the new circulars as JSON
+// CIRCULARS_NOTIFY_ROUTES_FILE=routes.json -> webhook of each category, see routesConfig. CIRCULARS_WEBHOOK_URL is the default
+// CIRCULARS_WEBHOOK_SECRET=secret -> sign the webhook payloads with the X-Signature header, see webhookNotifier
+// CIRCULARS_WEBHOOK_RETRIES=3 -> retries of a failed webhook. Deliveries are at-least-once, receivers must be idempotent
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"flag"
+	"fmt"
 	"github.com/PuerkitoBio/goquery"
 	_ "github.com/go-sql-driver/mysql"
 	"golang.org/x/net/html"
+	"io"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
 	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime/debug"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
@@ -26,7 +131,9 @@ import (
 // This is required since the server only send 100 circulars at a time
 type moreCircularsMsg struct {
 	Status bool
-	Data   int
+	// Data = Total number of circulars, as reported by the server
+	Data int
+	// Err, Errdbg = soft error reported by the server, empty when everything went fine
 	Err    string
 	Errdbg string
 	// Htm = table lines with circulars
@@ -38,64 +145,455 @@ type moreCircularsMsg struct {
 type attachment struct {
 	Id    uint64
 	Title string
+	// SortOrder = position of the attachment in the circular, as shown on the website
+	SortOrder int
+	// SizeBytes = file size shown next to the attachment, e.g. "(1.2 MB)". 0 when unknown
+	SizeBytes uint64
 }
 
 type circular struct {
 	// Id = attr 'id_doc` of tag with class 'download-file'
-	Id             uint64
-	Title          string
-	Category       string
-	PublishedDate  time.Time
+	Id       uint64
+	Title    string
+	Category string
+	// PublishedDate is the zero time when PublishedDateRaw couldn't be parsed
+	PublishedDate    time.Time
+	PublishedDateRaw string
+	// ValidUntilDate = last day shown by "Valido fino al". Whether the circular is still valid during that day
+	// is up to the consumers, /circulars/active follows CIRCULARS_VALID_UNTIL
 	ValidUntilDate time.Time
+	// ModifiedDate = last modified date, nil when it isn't shown or can't be parsed
+	ModifiedDate *time.Time `json:",omitempty"`
 	// Attachments = array of 'id_doc' from tags with class 'link-to-file'
 	Attachments []attachment
+	// Url = detail page of the circular on the "segreteria digitale"
+	Url string
+	// Extra = all the labeled span values, collected only when parseOptions.collectExtra is set
+	Extra map[string]string
+	// Pinned = the row is highlighted as important, see pinnedRowClasses
+	Pinned bool
+	// Protocol = official protocol number, from its span or the title. Empty when the circular has none
+	Protocol string
+	// RawHtml = html of the row, kept only when parseOptions.keepRawHtml is set. It's not part of the content hash
+	RawHtml string `json:"-"`
+	// Recipients = normalized audience of the circular, e.g. studenti, genitori. Empty when it isn't shown
+	Recipients []string
+	// SchoolYear = school year of the published date, e.g. 2023/2024. Empty when the date is unknown
+	SchoolYear string
+}
+
+// defaultSchoolYearStartMonth is the month the school year starts in Italy
+const defaultSchoolYearStartMonth = time.September
+
+// type parseOptions changes how parseCirculars handles the received html
+type parseOptions struct {
+	locale locale
+	// lenient falls back to the position of the spans when a label isn't found, instead of skipping the circular
+	lenient bool
+	// collectExtra enables collecting every labeled span value into circular.Extra
+	collectExtra bool
+	// keepRawHtml keeps the html of each row in circular.RawHtml
+	keepRawHtml bool
+	// mergeDuplicateAttachments keeps a single attachment per id in each circular, otherwise the repeated ones are kept
+	mergeDuplicateAttachments bool
+	// maxAttachmentTitleLen is the max length in characters of the attachments titles, 0 for no limit
+	maxAttachmentTitleLen int
+	// maxTitleLen and maxCategoryLen are the max lengths in characters of the circulars titles and categories, 0 for no limit
+	maxTitleLen, maxCategoryLen int
+	// schoolYearStartMonth is the first month of the school year, see schoolYear
+	schoolYearStartMonth time.Month
+}
+
+// truncate cuts s to at most max characters, returning whether it did. A max of 0 means no limit
+func truncate(s string, max int) (string, bool) {
+	if r := []rune(s); max > 0 && len(r) > max {
+		return string(r[:max]), true
+	}
+	return s, false
+}
+
+// type countingReader counts the bytes that have been read through it.
+// Used for measuring the bandwidth saved by gzip compression
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
 }
 
 type dbConfig struct {
 	ConnectionString string
 }
 
-// getCirculars returns all the circulars from the "segreteria digitale" of your school as parsable html.
+// type fetchOptions changes how getCirculars requests the circulars
+type fetchOptions struct {
+	// maxResponseBytes is the max size of a single decompressed response body
+	maxResponseBytes int64
+	// action and field are the 'a' and 'field' values of the search request
+	action string
+	field  string
+	// mode is either fetchModePost or fetchModeGet
+	mode string
+	// captureDir, when set, receives a copy of every raw response body, for reproducing parsing bugs
+	captureDir string
+	// errorSnippetBytes is how much of the body of a non-2xx response is shown in its error, 0 for none
+	errorSnippetBytes int
+	// tableWrap is one of the tableWrap modes, how the htm fragments of the search response are wrapped
+	tableWrap string
+}
+
+// Wrapping modes of the htm fragments of the search response, see wrapFragment
+const (
+	// tableWrapAuto wraps the fragments without a table of their own
+	tableWrapAuto = "auto"
+	// tableWrapAlways wraps every fragment, as bare rows
+	tableWrapAlways = "always"
+	// tableWrapNever keeps the fragments as they are
+	tableWrapNever = "never"
+)
+
+// wrapFragment returns the htm fragment of a search response inside a table, as expected by the parser.
+// Usually the fragment is bare rows, which the html parser would drop outside of a table, but some deployments send a whole table
+func wrapFragment(fragment, mode string) string {
+	if mode == tableWrapNever || (mode == tableWrapAuto && strings.Contains(strings.ToLower(fragment), "<table")) {
+		return fragment
+	}
+	return "<table>" + fragment + "</table>"
+}
+
+// Fetch modes of the circulars
+const (
+	// fetchModePost requests the circulars 100 at a time to the search endpoint, as JSON fragments
+	fetchModePost = "post"
+	// fetchModeGet requests the server rendered page with the circulars table
+	fetchModeGet = "get"
+)
+
+// newHTTPClient returns the client used for all the requests to the "segreteria digitale".
+// The transport is shared between requests and cycles, so connections are kept alive while paginating.
+// HTTP/2 is attempted even with a custom TLS config, which otherwise disables it
+func newHTTPClient(maxIdleConns int, idleConnTimeout, tlsHandshakeTimeout time.Duration, tlsConfig *tls.Config) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			// All requests go to the same host
+			MaxIdleConns:        maxIdleConns,
+			MaxIdleConnsPerHost: maxIdleConns,
+			IdleConnTimeout:     idleConnTimeout,
+			TLSHandshakeTimeout: tlsHandshakeTimeout,
+			TLSClientConfig:     tlsConfig,
+			ForceAttemptHTTP2:   true,
+		},
+	}
+}
+
+// type connReuse counts the requests of a fetch and how many of them reused a kept alive connection
+type connReuse struct {
+	mu       sync.Mutex
+	requests int
+	reused   int
+}
+
+// trace returns ctx with a trace counting the connections got by the requests made with it
+func (c *connReuse) trace(ctx context.Context) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.requests++
+			if info.Reused {
+				c.reused++
+			}
+		},
+	})
+}
+
+// log reports how many connections were reused and the protocol of the last response
+func (c *connReuse) log(proto string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	log.Printf("INFO: %d requests over %s, %d on reused connections", c.requests, proto, c.reused)
+}
+
+// readBody reads the whole response body and closes it, decompressing it when gzipped.
+// Returns also the number of bytes received, before decompression
+func readBody(resp *http.Response, maxBytes int64) (body []byte, wireBytes int64, err error) {
+	defer resp.Body.Close()
+
+	wire := &countingReader{r: resp.Body}
+	var r io.Reader = wire
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(wire)
+		if err != nil {
+			return nil, 0, errors.New("can't decompress response body")
+		}
+		r = gz
+	}
+
+	// Reading one more byte than allowed tells whether the limit has been exceeded
+	body, err = ioutil.ReadAll(io.LimitReader(r, maxBytes+1))
+	if err != nil {
+		return nil, 0, err
+	}
+	if int64(len(body)) > maxBytes {
+		return nil, 0, fmt.Errorf("response body exceeds %d bytes", maxBytes)
+	}
+	return body, wire.n, nil
+}
+
+// captureResponse writes the raw response body in dir, named after the time, the school and the 'ls' offset of the page.
+// A failure is only logged, capturing must not fail the cycle
+func captureResponse(dir, siteUrl string, offset int, ext string, body []byte) {
+	school := "unknown"
+	if u, err := url.Parse(siteUrl); err == nil && u.Query().Get("sede_codice") != "" {
+		school = sanitizeFileName(u.Query().Get("sede_codice"))
+	}
+	name := fmt.Sprintf("%s_%s_ls%d.%s", time.Now().UTC().Format("20060102T150405.000000000"), school, offset, ext)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Printf("WARNING: can't capture the response: %v", err)
+		return
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, name), body, 0644); err != nil {
+		log.Printf("WARNING: can't capture the response: %v", err)
+	}
+}
+
+// checkStatus returns an error for a non-2xx response, with the start of its body so e.g. a login or error page is recognizable
+func checkStatus(resp *http.Response, body []byte, snippetBytes int) error {
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		return nil
+	}
+	if snippetBytes <= 0 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	if len(body) > snippetBytes {
+		body = body[:snippetBytes]
+	}
+	snippet := strings.Join(strings.Fields(strings.ToValidUTF8(string(body), "")), " ")
+	return fmt.Errorf("unexpected status %s, body: %q", resp.Status, snippet)
+}
+
+// errMaintenance is returned when the "segreteria digitale" answers with its maintenance page
+var errMaintenance = errors.New("site in maintenance")
+
+// maintenanceSignatures are the texts of the maintenance page, compared in lower case
+var maintenanceSignatures = []string{"manutenzione", "maintenance"}
+
+// isMaintenancePage reports whether the response is the maintenance page instead of the circulars.
+// It's either a 503 or an html page mentioning the maintenance without any circular row, the JSON responses never are
+func isMaintenancePage(status int, body []byte) bool {
+	if status == http.StatusServiceUnavailable {
+		return true
+	}
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) == 0 || trimmed[0] != '<' || bytes.Contains(body, []byte("row-result")) {
+		return false
+	}
+	lower := bytes.ToLower(body)
+	for _, signature := range maintenanceSignatures {
+		if bytes.Contains(lower, []byte(signature)) {
+			return true
+		}
+	}
+	return false
+}
+
+// countRows returns the number of circular rows in a page of the search response, wrapped as in wrapMode
+func countRows(pageHtml, wrapMode string) (int, error) {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(wrapFragment(pageHtml, wrapMode)))
+	if err != nil {
+		return 0, err
+	}
+	return doc.Find("tr.row-result").Length(), nil
+}
+
+// checkMoreCirculars returns an error when the decoded page of the search response breaks the contract of moreCircularsMsg,
+// so a changed endpoint is reported instead of silently parsing nothing. Unknown fields are fine.
+// A first page with every field empty is only logged, it's also how a school without circulars could answer
+func checkMoreCirculars(body []byte, m moreCircularsMsg, offset int) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return errors.New("response body isn't a JSON object")
+	}
+	names := make([]string, 0, len(fields))
+	hasHtm := false
+	for name := range fields {
+		names = append(names, name)
+		// encoding/json matches the field names case insensitively
+		if strings.EqualFold(name, "htm") {
+			hasHtm = true
+		}
+	}
+	sort.Strings(names)
+
+	if !hasHtm {
+		return fmt.Errorf("response at offset %d has no htm field, the search endpoint may have changed. Received fields: %v", offset, names)
+	}
+	if strings.TrimSpace(m.Htm) == "" && m.Cnt > 0 {
+		return fmt.Errorf("response at offset %d reports %d more circulars but its htm is empty, the search endpoint may have changed", offset, m.Cnt)
+	}
+	if offset == 0 && strings.TrimSpace(m.Htm) == "" && m.Cnt == 0 && m.Data == 0 && !m.Status {
+		log.Printf("WARNING: first response has every field empty, either the school has no circulars or the search endpoint changed. Received fields: %v", names)
+	}
+	return nil
+}
+
+// getCirculars returns all the circulars from the "segreteria digitale" of your school as parsable html,
+// along with the total number of circulars reported by the server, 0 when unknown.
 // siteUrl -> "https://web.spaggiari.eu/sdg/app/default/comunicati.php?sede_codice=XXXX0000"
-func getCirculars(siteUrl string) (*strings.Reader, error) {
-	client := &http.Client{}
+func getCirculars(ctx context.Context, client *http.Client, siteUrl string, opts fetchOptions) (circularsReader *strings.Reader, expected int, err error) {
+	if opts.mode == fetchModeGet {
+		return getCircularsPage(ctx, client, siteUrl, opts)
+	}
+
 	count := 0
 	circularsHtml := ""
+	var wireBytes, decodedBytes int64
+	var conns connReuse
+	var proto string
+	traceCtx := conns.trace(ctx)
 
-	// get circulars 100 per request
+	// get circulars a page per request, the server sends 100 of them at a time
 	for {
-		req, err := http.NewRequest("POST", siteUrl, strings.NewReader(url.Values{"a": {"akSEARCH"}, "field": {"default"}, "search_term": {""}, "visua_storico": {"false"}, "ls": {strconv.Itoa(count)}}.Encode()))
+		req, err := http.NewRequestWithContext(traceCtx, "POST", siteUrl, strings.NewReader(url.Values{"a": {opts.action}, "field": {opts.field}, "search_term": {""}, "visua_storico": {"false"}, "ls": {strconv.Itoa(count)}}.Encode()))
 		if err != nil {
-			return nil, err
+			return nil, 0, err
 		}
 		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 		req.Header.Add("X-Requested-With", "XMLHttpRequest")
 		req.Header.Add("Accept-Charset", "UTF-8")
+		// Setting the header disables the transport transparent decompression, so the body is decompressed by readBody
+		req.Header.Add("Accept-Encoding", "gzip")
 		resp, err := client.Do(req)
 		if err != nil {
-			return nil, err
+			return nil, 0, err
+		}
+		proto = resp.Proto
+
+		body, wire, err := readBody(resp, opts.maxResponseBytes)
+		if err != nil {
+			return nil, 0, err
+		}
+		wireBytes += wire
+		decodedBytes += int64(len(body))
+		if opts.captureDir != "" {
+			captureResponse(opts.captureDir, siteUrl, count, "json", body)
 		}
+		if isMaintenancePage(resp.StatusCode, body) {
+			return nil, 0, errMaintenance
+		}
+		if err := checkStatus(resp, body, opts.errorSnippetBytes); err != nil {
+			return nil, 0, fmt.Errorf("offset %d: %w", count, err)
+		}
+		body = decodeCharset(resp.Header.Get("Content-Type"), body)
 
 		var m moreCircularsMsg
-		if err := json.NewDecoder(resp.Body).Decode(&m); err != nil {
-			return nil, errors.New("can't parse response body")
+		if err := json.Unmarshal(body, &m); err != nil {
+			return nil, 0, errors.New("can't parse response body")
+		}
+		if err := checkMoreCirculars(body, m, count); err != nil {
+			return nil, 0, err
+		}
+		// The server can report a soft error while still answering 200
+		if m.Err != "" || m.Errdbg != "" {
+			log.Printf("WARNING: server reported an error at offset %d: err=%q errdbg=%q", count, m.Err, m.Errdbg)
 		}
-		resp.Body.Close()
 
-		circularsHtml += m.Htm
+		if count == 0 {
+			expected = m.Data
+		}
+		circularsHtml += wrapFragment(m.Htm, opts.tableWrap)
 		if m.Cnt <= 0 {
 			break
 		}
-		count += 100
+		// The next offset follows the rows actually received, whatever the page size of the server
+		rows, err := countRows(m.Htm, opts.tableWrap)
+		if err != nil {
+			return nil, 0, err
+		}
+		if rows == 0 {
+			log.Printf("WARNING: server reported %d more circulars but sent an empty page at offset %d. Stopping", m.Cnt, count)
+			break
+		}
+		count += rows
+	}
+	log.Printf("INFO: downloaded %d bytes (%d uncompressed), gzip saved %d bytes", wireBytes, decodedBytes, decodedBytes-wireBytes)
+	conns.log(proto)
+
+	return strings.NewReader("<html><body>" + circularsHtml + "</body></html>"), expected, nil
+}
+
+// getCircularsPage returns the server rendered page with the circulars table, for deployments without the search endpoint.
+// The page doesn't report the number of circulars
+func getCircularsPage(ctx context.Context, client *http.Client, siteUrl string, opts fetchOptions) (circularsReader *strings.Reader, expected int, err error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", siteUrl, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Add("Accept-Charset", "UTF-8")
+	req.Header.Add("Accept-Encoding", "gzip")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, err
 	}
 
-	return strings.NewReader("<html><body><table>" + circularsHtml + "</table></body></html>"), nil
+	body, wire, err := readBody(resp, opts.maxResponseBytes)
+	if err != nil {
+		return nil, 0, err
+	}
+	log.Printf("INFO: downloaded %d bytes (%d uncompressed), gzip saved %d bytes", wire, len(body), int64(len(body))-wire)
+	if opts.captureDir != "" {
+		captureResponse(opts.captureDir, siteUrl, 0, "html", body)
+	}
+	if isMaintenancePage(resp.StatusCode, body) {
+		return nil, 0, errMaintenance
+	}
+	if err := checkStatus(resp, body, opts.errorSnippetBytes); err != nil {
+		return nil, 0, err
+	}
+	body = decodeCharset(resp.Header.Get("Content-Type"), body)
+
+	return strings.NewReader(string(body)), 0, nil
+}
+
+// documentUrl returns the url of a document of the "segreteria digitale", built from the site url of its school.
+// siteUrl -> "https://web.spaggiari.eu/sdg/app/default/comunicati.php?sede_codice=XXXX0000"
+// returns -> "https://web.spaggiari.eu/sdg/app/default/view_documento.php?a=<action>&id_documento=<id>&sede_codice=XXXX0000"
+func documentUrl(siteUrl, action string, id uint64) (string, error) {
+	u, err := url.Parse(siteUrl)
+	if err != nil {
+		return "", err
+	}
+	sedeCodice := u.Query().Get("sede_codice")
+	if sedeCodice == "" {
+		return "", errors.New("missing sede_codice in site url")
+	}
+
+	u.Path = path.Join(path.Dir(u.Path), "view_documento.php")
+	u.RawQuery = url.Values{"a": {action}, "id_documento": {strconv.FormatUint(id, 10)}, "sede_codice": {sedeCodice}}.Encode()
+	return u.String(), nil
+}
+
+// circularUrl returns the detail page of the circular
+func circularUrl(siteUrl string, id uint64) (string, error) {
+	return documentUrl(siteUrl, "akVIEW_FROM_ID", id)
 }
 
 // findNodeWithContext search the first node where the previous sibling Data contains the substring passed in as context.
 // In case node is nil, use 'exists' to check whether the node was found or not
 func findNodeWithContext(context string, s []*html.Node) (node *html.Node, exists bool) {
 	for _, n := range s {
+		if n.PrevSibling == nil || n.FirstChild == nil {
+			continue
+		}
 		if prev := n.PrevSibling.Data; strings.Contains(prev, context) {
 			return n.FirstChild, true
 		}
@@ -103,18 +601,245 @@ func findNodeWithContext(context string, s []*html.Node) (node *html.Node, exist
 	return nil, false
 }
 
-// function parseCirculars parses the html structure that's received
-func parseCirculars(circularsHtml *strings.Reader) (circulars []circular, err error) {
+// Positions of the field spans in the info column, used by the lenient parsing when a label isn't found
+const (
+	categorySpan   = 1
+	publishedSpan  = 2
+	validUntilSpan = 3
+)
+
+// findField returns the node of the field preceded by label.
+// In lenient mode, when the label isn't found, it falls back to the span at position
+func findField(id uint64, name, label string, position int, s []*html.Node, lenient bool) (node *html.Node, exists bool) {
+	if node, exists := findNodeWithContext(label, s); exists {
+		return node, true
+	}
+	if !lenient || position >= len(s) || s[position].FirstChild == nil {
+		return nil, false
+	}
+	log.Printf("WARNING: Circular %d, has no '%s' label. Using span %d\n", id, name, position)
+	return s[position].FirstChild, true
+}
+
+// errNoCircularRows is returned when the received html has no circular rows.
+// It usually means that the response is broken or its structure changed
+var errNoCircularRows = errors.New("no circular rows found")
+
+// type parseError describes a circular row that has been skipped while parsing
+type parseError struct {
+	// Id is 0 when the id itself couldn't be parsed
+	Id     uint64 `json:"id"`
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+func (e parseError) Error() string {
+	return fmt.Sprintf("circular %d, %s: %s", e.Id, e.Field, e.Reason)
+}
+
+// summarizeParseErrors counts the errors by field, adding them to the metrics, and returns the counts as "field: n" pairs
+func summarizeParseErrors(parseErrors []parseError) string {
+	counts := make(map[string]int)
+	for _, e := range parseErrors {
+		counts[e.Field]++
+		metricParseErrors.Add(e.Field, 1)
+	}
+	fields := make([]string, 0, len(counts))
+	for field := range counts {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	pairs := make([]string, len(fields))
+	for i, field := range fields {
+		pairs[i] = fmt.Sprintf("%s: %d", field, counts[field])
+	}
+	return strings.Join(pairs, ", ")
+}
+
+// collectLabeledSpans returns the text of every span preceded by a text label, keyed by the label without the trailing ':'
+func collectLabeledSpans(s []*html.Node) map[string]string {
+	labeled := make(map[string]string)
+	for _, n := range s {
+		prev := n.PrevSibling
+		if prev == nil || prev.Type != html.TextNode {
+			continue
+		}
+		label := strings.TrimSuffix(strings.TrimSpace(prev.Data), ":")
+		if label == "" {
+			continue
+		}
+		labeled[label] = strings.TrimSpace(goquery.NewDocumentFromNode(n).Text())
+	}
+	return labeled
+}
+
+// sizePattern matches a file size as shown next to the attachments, e.g. "(1.2 MB)" or "(350 KB)".
+// Both '.' and ',' are accepted as decimal separator. Parentheses are required, so titles like "Classe 2 B" don't match
+var sizePattern = regexp.MustCompile(`(?i)\(\s*(\d+(?:[.,]\d+)?)\s*(bytes?|b|kb|kib|mb|mib|gb|gib)\s*\)`)
+
+// sizeUnits are the multipliers of the size units, sizes are shown in multiples of 1024
+var sizeUnits = map[string]float64{
+	"b": 1, "byte": 1, "bytes": 1,
+	"kb": 1 << 10, "kib": 1 << 10,
+	"mb": 1 << 20, "mib": 1 << 20,
+	"gb": 1 << 30, "gib": 1 << 30,
+}
+
+// parseSize returns the size in bytes found in s and s without it.
+// Returns a size of 0 when s has none
+func parseSize(s string) (size uint64, rest string) {
+	loc := sizePattern.FindStringSubmatchIndex(s)
+	if loc == nil {
+		return 0, s
+	}
+	n, err := strconv.ParseFloat(strings.Replace(s[loc[2]:loc[3]], ",", ".", 1), 64)
+	if err != nil {
+		return 0, s
+	}
+	size = uint64(n * sizeUnits[strings.ToLower(s[loc[4]:loc[5]])])
+	return size, strings.TrimSpace(s[:loc[0]] + s[loc[1]:])
+}
+
+// mergeDuplicateAttachments keeps only the first attachment of each id, a repeated one only fills its missing size.
+// The attachments with the same title but different ids are distinct files, so they're all kept
+func mergeDuplicateAttachments(circularId uint64, attachments []attachment) []attachment {
+	merged := attachments[:0]
+	index := make(map[uint64]int)
+	for _, att := range attachments {
+		if i, ok := index[att.Id]; ok {
+			log.Printf("WARNING: circular(%d) attachment %d is repeated. Merging\n", circularId, att.Id)
+			if merged[i].SizeBytes == 0 {
+				merged[i].SizeBytes = att.SizeBytes
+			}
+			continue
+		}
+		index[att.Id] = len(merged)
+		merged = append(merged, att)
+	}
+	return merged
+}
+
+// findInfoColumn returns the cell of the row with the circular info, the one with the most spans,
+// so extra cells such as checkboxes or icons don't shift it. Falls back to the second cell
+func findInfoColumn(row *goquery.Selection) *goquery.Selection {
+	cells := row.Find("td")
+	best, bestSpans := cells.Eq(1), 0
+	cells.Each(func(i int, cell *goquery.Selection) {
+		if n := cell.Find("span").Length(); n > bestSpans {
+			best, bestSpans = cell, n
+		}
+	})
+	return best
+}
+
+// pinnedRowClasses are the classes of the rows highlighted as important
+var pinnedRowClasses = []string{"pinned", "important", "evidenza", "in-evidenza"}
+
+// isPinned reports whether the row is highlighted as important
+func isPinned(row *goquery.Selection) bool {
+	for _, class := range pinnedRowClasses {
+		if row.HasClass(class) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseProtocol returns the protocol number of the circular, from the span labeled with it or else from the title.
+// Returns an empty string when there's none
+func parseProtocol(title string, s []*html.Node, loc locale) string {
+	if node, exists := findNodeWithContext(loc.protocolLabel, s); exists {
+		if protocol := strings.TrimSpace(node.Data); protocol != "" {
+			return protocol
+		}
+	}
+	if m := loc.protocolPattern.FindStringSubmatch(title); m != nil {
+		return strings.TrimRight(m[1], ".-/")
+	}
+	return ""
+}
+
+// parseTitle returns the title of the circular, the text of the first span that isn't empty, e.g. after an icon, or else its title attribute.
+// Only the spans before the labeled fields are considered. Returns an empty string when there's none
+func parseTitle(spans *goquery.Selection) string {
+	for _, n := range spans.Nodes {
+		if prev := n.PrevSibling; prev != nil && prev.Type == html.TextNode && strings.TrimSpace(prev.Data) != "" {
+			break
+		}
+		s := goquery.NewDocumentFromNode(n).Selection
+		if text := s.Text(); strings.TrimSpace(text) != "" {
+			return text
+		}
+		if attr := strings.TrimSpace(s.AttrOr("title", "")); attr != "" {
+			return attr
+		}
+	}
+	return ""
+}
+
+// parseRecipients returns the recipients of the circular from the span labeled with them, or nil when there's none
+func parseRecipients(s []*html.Node, loc locale) []string {
+	node, exists := findNodeWithContext(loc.recipientsLabel, s)
+	if !exists {
+		return nil
+	}
+	return splitRecipients(node.Data)
+}
+
+// splitRecipients splits a comma or semicolon separated list of recipients into a sorted set, lowercased and without blanks
+func splitRecipients(s string) []string {
+	seen := make(map[string]bool)
+	var recipients []string
+	for _, r := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ';' }) {
+		r = strings.ToLower(strings.Join(strings.Fields(r), " "))
+		if r == "" || seen[r] {
+			continue
+		}
+		seen[r] = true
+		recipients = append(recipients, r)
+	}
+	sort.Strings(recipients)
+	return recipients
+}
+
+// schoolYear returns the school year of t as "yyyy/yyyy", the year of startMonth and the following one.
+// e.g. with September, both 01/09/2023 and 31/08/2024 are in 2023/2024. Returns an empty string for the zero time
+func schoolYear(t time.Time, startMonth time.Month) string {
+	if t.IsZero() {
+		return ""
+	}
+	start := t.Year()
+	if t.Month() < startMonth {
+		start--
+	}
+	return fmt.Sprintf("%d/%d", start, start+1)
+}
+
+// function parseCirculars parses the html structure that's received.
+// The rows that can't be parsed are skipped, parseErrors tells why
+func parseCirculars(circularsHtml *strings.Reader, opts parseOptions) (circulars []circular, parseErrors []parseError, err error) {
 	numRowResult := 0
 
 	// Load the HTML doc
 	doc, err := goquery.NewDocumentFromReader(circularsHtml)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+
+	// Zero rows must not be mistaken for zero circulars, as that would trigger their deletion
+	rows := doc.Find("tr.row-result")
+	if rows.Length() == 0 {
+		return nil, nil, errNoCircularRows
+	}
+
+	// skip records why the row is skipped
+	skip := func(id uint64, field, reason string) {
+		log.Printf("ERROR: Circular %d, %s. Skipping\n", id, reason)
+		parseErrors = append(parseErrors, parseError{id, field, reason})
 	}
 
 	// Parse single circular
-	doc.Find("tr.row-result").Each(func(i int, row *goquery.Selection) {
+	rows.Each(func(i int, row *goquery.Selection) {
 		// Parse circular ID
 		var id uint64
 		idStr, exist := row.Find(".download-file").Attr("id_doc")
@@ -123,46 +848,68 @@ func parseCirculars(circularsHtml *strings.Reader) (circulars []circular, err er
 		}
 		id, err := strconv.ParseUint(idStr, 10, 64)
 		if err != nil {
-			log.Println("ERROR: can't parse id to int. Skipping")
+			skip(0, "id", fmt.Sprintf("can't parse id %q to int", idStr))
 			return
 		}
 
 		// Get useful tag references
-		infoColumn := row.Find("td").Eq(1)
+		infoColumn := findInfoColumn(row)
 		spanTags := infoColumn.Find("span")
 
 		// Parse circular info
-		title := spanTags.First().Text()
+		title := parseTitle(spanTags)
 		if title == "" {
-			log.Printf("ERROR: Circular %d, has no 'title' field. Skipping\n", id)
+			skip(id, "title", "has no 'title' field")
 			return
 		}
-		category, exist := findNodeWithContext("Categoria", spanTags.Nodes)
+		category, exist := findField(id, "category", opts.locale.categoryLabel, categorySpan, spanTags.Nodes, opts.lenient)
 		if !exist {
-			log.Printf("ERROR: Circular %d, has no 'category' field. Skipping\n", id)
+			skip(id, "category", "has no 'category' field")
 			return
 		}
-		publishedDateStr, exist := findNodeWithContext("Pubblicato il", spanTags.Nodes)
+		publishedDateStr, exist := findField(id, "published date", opts.locale.publishedLabel, publishedSpan, spanTags.Nodes, opts.lenient)
 		if !exist {
-			log.Printf("ERROR: Circular %d, has no 'published date' field. Skipping\n", id)
+			skip(id, "published date", "has no 'published date' field")
 			return
 		}
-		publishedDate, err := time.Parse("02/01/2006", publishedDateStr.Data)
+		// Keep the circular even when the date can't be parsed, the raw value is stored anyway
+		publishedDate, err := time.Parse(opts.locale.dateLayout, publishedDateStr.Data)
 		if err != nil {
-			log.Printf("ERROR: Circular %d, can't parse published date. Skipping\n", id)
-			return
+			log.Printf("ERROR: Circular %d, can't parse published date %q. Keeping raw value\n", id, publishedDateStr.Data)
+			publishedDate = time.Time{}
 		}
-		validUntilDateStr, exist := findNodeWithContext("Valido fino", spanTags.Nodes)
+		validUntilDateStr, exist := findField(id, "valid until", opts.locale.validUntilLabel, validUntilSpan, spanTags.Nodes, opts.lenient)
 		if !exist {
-			log.Printf("ERROR: Circular %d, has no 'valid until' field. Skipping\n", id)
+			skip(id, "valid until", "has no 'valid until' field")
 			return
 		}
-		validUntilDate, err := time.Parse("02/01/2006", validUntilDateStr.Data)
+		validUntilDate, err := time.Parse(opts.locale.dateLayout, validUntilDateStr.Data)
 		if err != nil {
-			log.Printf("ERROR: Circular %d, can't parse valid until date. Skipping\n", id)
+			skip(id, "valid until", fmt.Sprintf("can't parse valid until date %q", validUntilDateStr.Data))
 			return
 		}
 
+		// The modified date is optional, the circular is kept without it
+		var modifiedDate *time.Time
+		if modifiedDateStr, exist := findNodeWithContext(opts.locale.modifiedLabel, spanTags.Nodes); exist {
+			if d, err := time.Parse(opts.locale.dateLayout, strings.TrimSpace(modifiedDateStr.Data)); err == nil {
+				modifiedDate = &d
+			} else {
+				log.Printf("WARNING: Circular %d, can't parse modified date %q. Ignoring it\n", id, modifiedDateStr.Data)
+			}
+		}
+
+		// A value longer than its column would fail the insert of the whole cycle
+		if truncated, ok := truncate(title, opts.maxTitleLen); ok {
+			log.Printf("WARNING: Circular %d, title is longer than %d characters. Truncating\n", id, opts.maxTitleLen)
+			title = truncated
+		}
+		categoryName := category.Data
+		if truncated, ok := truncate(categoryName, opts.maxCategoryLen); ok {
+			log.Printf("WARNING: Circular %d, category is longer than %d characters. Truncating\n", id, opts.maxCategoryLen)
+			categoryName = truncated
+		}
+
 		var attachments []attachment
 		// Parse attachments, tag with class 'link-to-file' inside infoColumn
 		infoColumn.Find(".link-to-file").Each(func(i int, a *goquery.Selection) {
@@ -172,110 +919,625 @@ func parseCirculars(circularsHtml *strings.Reader) (circulars []circular, err er
 					log.Printf("WARNING: can't parse circular(%d) attachment. Skipping attachment\n", id)
 					return
 				}
-				title := a.Text()
-				attachments = append(attachments, attachment{idDoc, title})
+				// The size is shown either in the link text or right after it
+				size, title := parseSize(a.Text())
+				if next := a.Nodes[0].NextSibling; size == 0 && next != nil && next.Type == html.TextNode {
+					size, _ = parseSize(next.Data)
+				}
+				// Keep the titles clean and within the column size
+				title = strings.TrimSpace(title)
+				if title == "" {
+					title = fmt.Sprintf("%s %d", opts.locale.attachmentPlaceholder, idDoc)
+					log.Printf("WARNING: circular(%d) attachment %d has no title. Using %q\n", id, idDoc, title)
+				}
+				if truncated, ok := truncate(title, opts.maxAttachmentTitleLen); ok {
+					log.Printf("WARNING: circular(%d) attachment %d title is longer than %d characters. Truncating\n", id, idDoc, opts.maxAttachmentTitleLen)
+					title = truncated
+				}
+				attachments = append(attachments, attachment{idDoc, title, i, size})
 			}
 		})
+		if opts.mergeDuplicateAttachments {
+			attachments = mergeDuplicateAttachments(id, attachments)
+		}
+
+		var extra map[string]string
+		if opts.collectExtra {
+			if extra = collectLabeledSpans(spanTags.Nodes); len(extra) == 0 {
+				extra = nil
+			}
+		}
+
+		var rawHtml string
+		if opts.keepRawHtml {
+			if rawHtml, err = goquery.OuterHtml(row); err != nil {
+				log.Printf("WARNING: Circular %d, can't render the row html: %v", id, err)
+			}
+		}
 
 		// Add parsed circular to array
-		circulars = append(circulars, circular{id, title, category.Data, publishedDate, validUntilDate, attachments})
+		circulars = append(circulars, circular{
+			Id:               id,
+			Title:            title,
+			Category:         categoryName,
+			PublishedDate:    publishedDate,
+			PublishedDateRaw: publishedDateStr.Data,
+			ValidUntilDate:   validUntilDate,
+			ModifiedDate:     modifiedDate,
+			Attachments:      attachments,
+			Extra:            extra,
+			Pinned:           isPinned(row),
+			Protocol:         parseProtocol(title, spanTags.Nodes, opts.locale),
+			RawHtml:          rawHtml,
+			Recipients:       parseRecipients(spanTags.Nodes, opts.locale),
+			SchoolYear:       schoolYear(publishedDate, opts.schoolYearStartMonth),
+		})
 
 		numRowResult++
 	})
 
-	return circulars, nil
+	return circulars, parseErrors, nil
 }
 
-// loadConfiguration loads db config from file
-func loadConfiguration(filename string) (*dbConfig, error) {
-	configFile, err := os.Open(filename)
-	if err != nil {
-		return nil, err
+// nullableDate formats the date for the DB, the zero time is stored as NULL
+func nullableDate(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
 	}
+	return t.Format("2006-01-02")
+}
 
-	config := &dbConfig{}
-	if err := json.NewDecoder(configFile).Decode(&config); err != nil {
-		return nil, err
+// nullableDatePtr returns the date for the DB, nil is stored as NULL
+func nullableDatePtr(t *time.Time) interface{} {
+	if t == nil {
+		return nil
 	}
-
-	return config, nil
+	return nullableDate(*t)
 }
 
-func insertCirculars(circulars []circular, numToUpdate int, connectionString string) error {
-	db, err := sql.Open("mysql", connectionString)
+// contentHash returns the hex SHA-256 of the JSON of the circular, so every parsed value and attachment is part of it.
+// encoding/json sorts the keys of Extra, so equal circulars have equal hashes. RawHtml isn't marshaled, so it's left out
+func contentHash(c circular) (string, error) {
+	b, err := json.Marshal(c)
 	if err != nil {
-		return err
-	}
-	defer db.Close()
-
-	if err := db.Ping(); err != nil {
-		return err
+		return "", err
 	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
 
-	tx, err := db.Begin()
-	if err != nil {
-		return err
-	}
+// type storedVersion is what insertCirculars compares of a stored circular before updating it
+type storedVersion struct {
+	// hash is empty for the circulars stored before hashing
+	hash, title string
+	// publishedDate is yyyy-mm-dd, empty when unknown
+	publishedDate string
+}
 
-	// Insert for each circular
-	for idx, c := range circulars {
-		// Updates only latest 'numToUpdate' circulars
-		queryCircular := "INSERT IGNORE INTO `circolare` (id, titolo, categoria, `data`, valida_fino, aggiunta_il) VALUES (?, ?, ?, ?, ?, ?)"
-		queryAttachment := "INSERT IGNORE INTO `circolare_allegato` (id_allegato, titolo, id_circolare) VALUES (?, ?, ?)"
-		if idx < numToUpdate {
-			queryCircular = "INSERT INTO `circolare` (id, titolo, categoria, `data`, valida_fino, aggiunta_il) VALUES (?, ?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE titolo = VALUES(titolo), categoria = VALUES(categoria), `data` = VALUES(`data`), valida_fino = VALUES(valida_fino)"
-			queryAttachment = "INSERT INTO `circolare_allegato` (id_allegato, titolo, id_circolare) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE titolo = VALUES(titolo)"
+// storedVersions returns the stored circulars among ids
+func storedVersions(ctx context.Context, tx *sql.Tx, ids []uint64) (map[uint64]storedVersion, error) {
+	col := columns
+	versions := make(map[uint64]storedVersion)
+	for len(ids) > 0 {
+		n := len(ids)
+		if n > maxStatementIds {
+			n = maxStatementIds
 		}
+		chunk := ids[:n]
+		ids = ids[n:]
 
-		_, err = tx.Exec(
-			// INSERT IGNORE would be better but circulars must not be deleted from website (not our case)
-			queryCircular,
-			c.Id,
-			c.Title,
-			c.Category,
-			c.PublishedDate.Format("2006-01-02"),
-			c.ValidUntilDate.Format("2006-01-02"),
-			time.Now().UTC().Format(time.RFC3339))
+		args := make([]interface{}, len(chunk))
+		for i, id := range chunk {
+			args[i] = id
+		}
+		rows, err := tx.QueryContext(ctx,
+			"SELECT `"+col.id+"`, `"+col.contentHash+"`, `"+col.title+"`, `"+col.publishedDate+"` FROM circolare WHERE `"+col.id+"` IN (?"+strings.Repeat(", ?", len(chunk)-1)+")",
+			args...)
 		if err != nil {
-			return err
+			return nil, err
 		}
-
-		// Insert circulars attachments
-		for _, att := range c.Attachments {
-			_, err = tx.Exec(
-				// INSERT IGNORE would be better but circulars must not be deleted from website (not our case)
-				queryAttachment,
-				att.Id,
-				att.Title,
-				c.Id)
-			if err != nil {
-				return err
+		for rows.Next() {
+			var id uint64
+			var v storedVersion
+			var hash, published sql.NullString
+			if err := rows.Scan(&id, &hash, &v.title, &published); err != nil {
+				rows.Close()
+				return nil, err
 			}
+			v.hash, v.publishedDate = hash.String, published.String
+			versions[id] = v
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
 		}
 	}
+	return versions, nil
+}
 
-	if err := tx.Commit(); err != nil {
-		return err
+// nullableString returns s for the DB, the empty string is stored as NULL
+func nullableString(s string) interface{} {
+	if s == "" {
+		return nil
 	}
+	return s
+}
 
-	return nil
+// nullableSize returns the size for the DB, an unknown size is stored as NULL
+func nullableSize(size uint64) interface{} {
+	if size == 0 {
+		return nil
+	}
+	return size
 }
 
-func deleteRemovedCirculars(circulars []circular, connectionString string) (removedCirculars, removedAttachments int, err error) {
-	db, err := sql.Open("mysql", connectionString)
+// loadConfiguration loads db config from file
+func loadConfiguration(filename string) (*dbConfig, error) {
+	configFile, err := os.Open(filename)
 	if err != nil {
-		return 0, 0, err
+		return nil, err
 	}
-	defer db.Close()
 
-	if err := db.Ping(); err != nil {
+	config := &dbConfig{}
+	if err := json.NewDecoder(configFile).Decode(&config); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// type conflictStrategy decides whether a circular that's already in the DB gets updated or left untouched.
+// idx is the position of the circular in the parsed ones, the most recent come first
+type conflictStrategy func(idx int, c circular) bool
+
+// defaultConflictStrategy updates only the latest 25 circulars, older ones are unlikely to change
+const defaultConflictStrategy = "upsert-recent-25"
+
+// upsertAll is the strategy updating every stored circular
+func upsertAll(int, circular) bool { return true }
+
+// parseConflictStrategy returns the strategy described by s, one of:
+// "ignore-all" -> never update
+// "upsert-all" -> always update
+// "upsert-recent-N" -> update only the latest N circulars
+// "upsert-since-<date>" -> update only circulars published since date, with the locale date layout
+func parseConflictStrategy(s string, dateLayout string) (conflictStrategy, error) {
+	switch {
+	case s == "ignore-all":
+		return func(int, circular) bool { return false }, nil
+	case s == "upsert-all":
+		return upsertAll, nil
+	case strings.HasPrefix(s, "upsert-recent-"):
+		n, err := strconv.Atoi(strings.TrimPrefix(s, "upsert-recent-"))
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid number of circulars in %q", s)
+		}
+		return func(idx int, _ circular) bool { return idx < n }, nil
+	case strings.HasPrefix(s, "upsert-since-"):
+		since, err := time.Parse(dateLayout, strings.TrimPrefix(s, "upsert-since-"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid date in %q (%s)", s, dateLayout)
+		}
+		return func(_ int, c circular) bool { return !c.PublishedDate.Before(since) }, nil
+	}
+	return nil, fmt.Errorf("unknown strategy %q", s)
+}
+
+// type commitError is returned when the statements succeeded but the commit didn't.
+// Nothing has been persisted, so the whole transaction can be retried
+type commitError struct {
+	err error
+}
+
+func (e *commitError) Error() string { return "commit failed: " + e.err.Error() }
+
+func (e *commitError) Unwrap() error { return e.err }
+
+// insertAttempts is how many times a transaction failing to commit is executed
+const insertAttempts = 3
+
+// insertCirculars inserts the circulars in the DB, circulars that are already stored are updated only when shouldUpdate says so.
+// Returns the circulars that have been newly inserted and how many have been updated, only after the commit succeeded
+func insertCirculars(ctx context.Context, db *sql.DB, circulars []circular, shouldUpdate conflictStrategy) (inserted []circular, updated int, err error) {
+	if err := db.PingContext(ctx); err != nil {
+		return nil, 0, err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	// The pool is shared, so the connection must be released when returning early. No-op after Commit
+	defer tx.Rollback()
+
+	// The queries follow the column mapping, the values are in the same order
+	col := columns
+	circularColumns := quoteColumns(col.id, col.title, col.category, col.publishedDate, col.publishedDateRaw, col.validUntilDate, col.url, col.extra, col.pinned, col.protocol, col.addedAt, col.updatedAt, col.contentHash, col.recipients, col.schoolYear, col.modifiedDate)
+	attachmentColumns := quoteColumns(col.attachmentId, col.attachmentTitle, col.attachmentCircularId, col.attachmentSortOrder, col.attachmentSize)
+	insertCircular := "INSERT IGNORE INTO `circolare` (" + circularColumns + ") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+	insertAttachment := "INSERT IGNORE INTO `circolare_allegato` (" + attachmentColumns + ") VALUES (?, ?, ?, ?, ?)"
+	// The update time changes only when a value does. MySQL assigns from left to right, so it's compared before anything is overwritten
+	updatable := []string{col.title, col.category, col.publishedDate, col.publishedDateRaw, col.validUntilDate, col.url, col.pinned, col.protocol, col.recipients, col.schoolYear, col.modifiedDate}
+	upsertCircular := "INSERT INTO `circolare` (" + circularColumns + ") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE " +
+		"`" + col.updatedAt + "` = IF(" + unchangedColumns(updatable...) + " AND (VALUES(`" + col.extra + "`) IS NULL OR `" + col.extra + "` <=> VALUES(`" + col.extra + "`)), `" + col.updatedAt + "`, VALUES(`" + col.updatedAt + "`)), " +
+		updateColumns(updatable...) +
+		", `" + col.extra + "` = COALESCE(VALUES(`" + col.extra + "`), `" + col.extra + "`)" +
+		// The hash isn't compared, the circulars stored before hashing would all look updated
+		", " + updateColumns(col.contentHash)
+	// A size that's no longer shown is kept, it may have been probed
+	upsertAttachment := "INSERT INTO `circolare_allegato` (" + attachmentColumns + ") VALUES (?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE " +
+		updateColumns(col.attachmentTitle, col.attachmentSortOrder) +
+		", `" + col.attachmentSize + "` = COALESCE(VALUES(`" + col.attachmentSize + "`), `" + col.attachmentSize + "`)"
+	insertHtml := "INSERT IGNORE INTO `circolare_html` (`id_circolare`, `html`) VALUES (?, ?)"
+	upsertHtml := "INSERT INTO `circolare_html` (`id_circolare`, `html`) VALUES (?, ?) ON DUPLICATE KEY UPDATE " + updateColumns("html")
+
+	// The circulars chosen by the strategy are updated only when their hash changed
+	hashes := make([]string, len(circulars))
+	var toUpdate []uint64
+	for idx, c := range circulars {
+		if hashes[idx], err = contentHash(c); err != nil {
+			return nil, 0, err
+		}
+		if shouldUpdate(idx, c) {
+			toUpdate = append(toUpdate, c.Id)
+		}
+	}
+	stored, err := storedVersions(ctx, tx, toUpdate)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Insert for each circular
+	now := time.Now().UTC().Format(time.RFC3339)
+	skipped, kept := 0, 0
+	for idx, c := range circulars {
+		// Updates only the circulars chosen by the strategy, a missing attachment is still inserted
+		queryCircular, queryAttachment := insertCircular, insertAttachment
+		if shouldUpdate(idx, c) {
+			v, exists := stored[c.Id]
+			switch {
+			case exists && v.hash == hashes[idx]:
+				skipped++
+			case exists && idReuse.suspected(v, c):
+				log.Printf("WARNING: circular %d looks like another circular reusing the id, stored %q (%s), parsed %q (%s)", c.Id, v.title, v.publishedDate, c.Title, c.PublishedDateRaw)
+				metricIdReuseSuspected.Add(1)
+				// Neither the circular nor its attachments overwrite the stored one
+				if idReuse.keepStored {
+					kept++
+					continue
+				}
+				queryCircular, queryAttachment = upsertCircular, upsertAttachment
+			default:
+				queryCircular, queryAttachment = upsertCircular, upsertAttachment
+			}
+		}
+
+		// Extra is stored as JSON, NULL when not collected
+		var extra interface{}
+		if c.Extra != nil {
+			extraJson, err := json.Marshal(c.Extra)
+			if err != nil {
+				return nil, 0, err
+			}
+			extra = string(extraJson)
+		}
+
+		res, err := tx.ExecContext(
+			ctx,
+			// INSERT IGNORE would be better but circulars must not be deleted from website (not our case)
+			queryCircular,
+			c.Id,
+			c.Title,
+			c.Category,
+			nullableDate(c.PublishedDate),
+			c.PublishedDateRaw,
+			c.ValidUntilDate.Format("2006-01-02"),
+			c.Url,
+			extra,
+			c.Pinned,
+			nullableString(c.Protocol),
+			now,
+			now,
+			hashes[idx],
+			nullableString(strings.Join(c.Recipients, ",")),
+			nullableString(c.SchoolYear),
+			nullableDatePtr(c.ModifiedDate))
+		if err != nil {
+			return nil, 0, err
+		}
+		// MySQL reports 1 affected row for a new row, 2 for an updated one and 0 for an unchanged one
+		switch affected, _ := res.RowsAffected(); affected {
+		case 1:
+			inserted = append(inserted, c)
+		case 2:
+			updated++
+		}
+
+		// Insert circulars attachments
+		for _, att := range c.Attachments {
+			_, err = tx.ExecContext(
+				ctx,
+				// INSERT IGNORE would be better but circulars must not be deleted from website (not our case)
+				queryAttachment,
+				att.Id,
+				att.Title,
+				c.Id,
+				att.SortOrder,
+				nullableSize(att.SizeBytes))
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+
+		// The html is replaced along with the circular
+		if c.RawHtml != "" {
+			compressed, err := compressHtml(c.RawHtml)
+			if err != nil {
+				return nil, 0, err
+			}
+			queryHtml := insertHtml
+			if queryCircular == upsertCircular {
+				queryHtml = upsertHtml
+			}
+			if _, err := tx.ExecContext(ctx, queryHtml, c.Id, compressed); err != nil {
+				return nil, 0, err
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, 0, &commitError{err}
+	}
+	if skipped > 0 {
+		log.Printf("INFO: skipped the update of %d unchanged circulars", skipped)
+		metricSkippedUpdates.Add(int64(skipped))
+	}
+	if kept > 0 {
+		log.Printf("WARNING: kept %d stored circulars instead of overwriting them with a reused id", kept)
+	}
+
+	return inserted, updated, nil
+}
+
+// waitForDB pings the DB until it answers, retrying with an exponential backoff for at most timeout
+func waitForDB(db *sql.DB, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		err := db.Ping()
+		if err == nil {
+			return nil
+		}
+		if time.Now().Add(backoff).After(deadline) {
+			return fmt.Errorf("DB not ready after %v: %v", timeout, err)
+		}
+
+		log.Printf("WARNING: DB not ready (attempt %d), retrying in %v: %v", attempt, backoff, err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > 30*time.Second {
+			backoff = 30 * time.Second
+		}
+	}
+}
+
+// pingDB pings the DB every interval until ctx is done, so dead pooled connections are discarded between cycles
+func pingDB(ctx context.Context, db *sql.DB, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := db.PingContext(ctx); err != nil && ctx.Err() == nil {
+				log.Printf("WARNING: DB ping failed: %v", err)
+			}
+		}
+	}
+}
+
+// hasUniqueKey reports whether column alone is the primary key or a unique key of table, using information_schema
+func hasUniqueKey(db *sql.DB, table, column string) (bool, error) {
+	var count int
+	err := db.QueryRow(
+		"SELECT COUNT(*) FROM ("+
+			"SELECT INDEX_NAME FROM information_schema.STATISTICS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND NON_UNIQUE = 0 "+
+			"GROUP BY INDEX_NAME HAVING COUNT(*) = 1 AND MAX(COLUMN_NAME) = ?) unique_keys",
+		table,
+		column).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// checkUniqueKeys warns when the ids aren't unique keys, as the upserts rely on them to detect duplicates
+func checkUniqueKeys(db *sql.DB) {
+	for _, k := range []struct{ table, column string }{{"circolare", columns.id}, {"circolare_allegato", columns.attachmentId}} {
+		unique, err := hasUniqueKey(db, k.table, k.column)
+		if err != nil {
+			log.Printf("WARNING: can't check the keys of %s: %v", k.table, err)
+			continue
+		}
+		if !unique {
+			log.Printf("WARNING: %s.%s isn't a primary or unique key! Upserts can't detect duplicates and every cycle will add duplicate rows", k.table, k.column)
+		}
+	}
+}
+
+// checkColumnLengths warns when the configured max lengths don't fit the VARCHAR columns, as an oversized value fails the whole insert
+func checkColumnLengths(db *sql.DB, opts parseOptions) {
+	for _, c := range []struct {
+		table, column, env string
+		max                int
+	}{
+		{"circolare", columns.title, "CIRCULARS_MAX_TITLE_LENGTH", opts.maxTitleLen},
+		{"circolare", columns.category, "CIRCULARS_MAX_CATEGORY_LENGTH", opts.maxCategoryLen},
+		{"circolare_allegato", columns.attachmentTitle, "CIRCULARS_MAX_ATTACHMENT_TITLE_LENGTH", opts.maxAttachmentTitleLen},
+	} {
+		var length sql.NullInt64
+		err := db.QueryRow(
+			"SELECT CHARACTER_MAXIMUM_LENGTH FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?",
+			c.table,
+			c.column).Scan(&length)
+		if err != nil {
+			log.Printf("WARNING: can't check the size of %s.%s: %v", c.table, c.column, err)
+			continue
+		}
+		// TEXT columns are large enough
+		if !length.Valid || length.Int64 > 65535 {
+			continue
+		}
+		if c.max == 0 || int64(c.max) > length.Int64 {
+			log.Printf("WARNING: %s.%s holds %d characters but %s is %d, longer values will fail the insert", c.table, c.column, length.Int64, c.env, c.max)
+		}
+	}
+}
+
+// maxStatementIds limits the ids used by a single statement, well below the MySQL limit of 65535 placeholders
+const maxStatementIds = 1000
+
+// execByIds executes query, ending with 'IN', on the ids with a statement every maxStatementIds ids.
+// Returns the total of the affected rows
+func execByIds(ctx context.Context, tx *sql.Tx, query string, ids []uint64) (affected int64, err error) {
+	for len(ids) > 0 {
+		n := len(ids)
+		if n > maxStatementIds {
+			n = maxStatementIds
+		}
+		chunk := ids[:n]
+		ids = ids[n:]
+
+		args := make([]interface{}, len(chunk))
+		for i, id := range chunk {
+			args[i] = id
+		}
+		res, err := tx.ExecContext(ctx, query+" (?"+strings.Repeat(", ?", len(chunk)-1)+")", args...)
+		if err != nil {
+			return affected, err
+		}
+		rows, err := res.RowsAffected()
+		if err != nil {
+			return affected, err
+		}
+		affected += rows
+	}
+	return affected, nil
+}
+
+// deleteByIds deletes from table the rows whose column is one of ids, returning how many have been deleted
+func deleteByIds(ctx context.Context, tx *sql.Tx, table, column string, ids []uint64) (int64, error) {
+	return execByIds(ctx, tx, "DELETE FROM `"+table+"` WHERE `"+column+"` IN", ids)
+}
+
+// idsToRemove returns the dbIds that aren't in parsedIds.
+// parsedIds gets sorted in descending order, so the first index where parsedIds[i] <= id is the only candidate match.
+// When id is smaller than all the parsed ids, or nothing was parsed, the search returns len(parsedIds)
+func idsToRemove(dbIds, parsedIds []uint64) []uint64 {
+	sort.Slice(parsedIds, func(i, j int) bool { return parsedIds[i] > parsedIds[j] })
+
+	var toRemove []uint64
+	for _, id := range dbIds {
+		if idx := sort.Search(len(parsedIds), func(i int) bool { return parsedIds[i] <= id }); idx == len(parsedIds) || parsedIds[idx] != id {
+			toRemove = append(toRemove, id)
+		}
+	}
+	return toRemove
+}
+
+// type cleanupScope limits which stored circulars are compared with the parsed ones during cleanup.
+// Only recent circulars get deleted upstream, so the older ones don't need to be read every time
+type cleanupScope struct {
+	// fetchedOnly limits the comparison to the ids not smaller than the smallest parsed one
+	fetchedOnly bool
+	// recentDays, when positive, limits the comparison to the circulars published in the last recentDays days
+	recentDays int
+	// minId, when positive, leaves the circulars with a smaller id out of the comparison, see CIRCULARS_MIN_ID
+	minId uint64
+	// minDate and maxDate, when set, leave the circulars published out of the range out of the comparison,
+	// see CIRCULARS_MIN_DATE and CIRCULARS_MAX_DATE. The circulars without a published date stay in scope, as they're parsed
+	minDate, maxDate time.Time
+}
+
+// parseCleanupScope returns the scope described by s, one of:
+// "all" -> compare every stored circular
+// "fetched" -> compare only the stored circulars in the id window that has been fetched
+// "recent-Nd" -> compare only the stored circulars published in the last N days
+func parseCleanupScope(s string) (cleanupScope, error) {
+	switch {
+	case s == "all":
+		return cleanupScope{}, nil
+	case s == "fetched":
+		return cleanupScope{fetchedOnly: true}, nil
+	case strings.HasPrefix(s, "recent-") && strings.HasSuffix(s, "d"):
+		days, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(s, "recent-"), "d"))
+		if err != nil || days <= 0 {
+			return cleanupScope{}, fmt.Errorf("invalid number of days in %q", s)
+		}
+		return cleanupScope{recentDays: days}, nil
+	}
+	return cleanupScope{}, fmt.Errorf("unknown scope %q", s)
+}
+
+// where returns the condition on the circolare table aliased as 'c' selecting the circulars in scope, with its args.
+// Returns an empty condition when every circular is in scope
+func (scope cleanupScope) where(parsedCircId []uint64) (cond string, args []interface{}) {
+	var conds []string
+	if scope.fetchedOnly {
+		minId := parsedCircId[0]
+		for _, id := range parsedCircId {
+			if id < minId {
+				minId = id
+			}
+		}
+		conds = append(conds, "c.`"+columns.id+"` >= ?")
+		args = append(args, minId)
+	}
+	if scope.minId > 0 {
+		conds = append(conds, "c.`"+columns.id+"` >= ?")
+		args = append(args, scope.minId)
+	}
+	if scope.recentDays > 0 {
+		conds = append(conds, "c.`"+columns.publishedDate+"` >= ?")
+		args = append(args, time.Now().AddDate(0, 0, -scope.recentDays).Format("2006-01-02"))
+	}
+	if !scope.minDate.IsZero() {
+		conds = append(conds, "(c.`"+columns.publishedDate+"` IS NULL OR c.`"+columns.publishedDate+"` >= ?)")
+		args = append(args, scope.minDate.Format("2006-01-02"))
+	}
+	if !scope.maxDate.IsZero() {
+		conds = append(conds, "(c.`"+columns.publishedDate+"` IS NULL OR c.`"+columns.publishedDate+"` <= ?)")
+		args = append(args, scope.maxDate.Format("2006-01-02"))
+	}
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+// cleanupInterval is how often the cleanup runs, at most. The next one is due cleanupInterval after the start of
+// the hour of the cycle that attempted the last one, the first one cleanupInterval after the startup
+const cleanupInterval = 6 * time.Hour
+
+// errCleanupRefused is returned when the cleanup would remove too many circulars, nothing is deleted
+var errCleanupRefused = errors.New("cleanup refused")
+
+// deleteRemovedCirculars removes from the DB the circulars and attachments in scope that weren't parsed.
+// With a positive grace, a missing circular is only marked with missing_since and deleted, with its attachments,
+// once it's been missing for grace, so a transient glitch upstream doesn't delete anything. It's unmarked when parsed again.
+// The cleanup is all-or-nothing, on any error nothing is deleted.
+// It's refused when nothing was parsed or when it would remove more than maxDeletePercent of the circulars in scope
+func deleteRemovedCirculars(ctx context.Context, db *sql.DB, circulars []circular, scope cleanupScope, grace time.Duration, maxDeletePercent int) (removedCirculars, removedAttachments int, err error) {
+	if err := db.PingContext(ctx); err != nil {
 		return 0, 0, err
 	}
 
-	tx, err := db.Begin()
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
 		return 0, 0, err
 	}
+	// The pool is shared, so the connection must be released when returning early. No-op after Commit
+	defer tx.Rollback()
 
 	// Get parsed ids
 	var parsedCircId, parsedAttachId []uint64
@@ -286,80 +1548,739 @@ func deleteRemovedCirculars(circulars []circular, connectionString string) (remo
 			parsedAttachId = append(parsedAttachId, att.Id)
 		}
 	}
-	sort.Slice(parsedCircId, func(i, j int) bool { return parsedCircId[i] > parsedCircId[j] })
-	sort.Slice(parsedAttachId, func(i, j int) bool { return parsedAttachId[i] > parsedAttachId[j] })
 
-	// Get db ids
+	// Nothing to compare the window with
+	if scope.fetchedOnly && len(parsedCircId) == 0 {
+		return 0, 0, nil
+	}
+
+	// Get db ids in scope, attachments are in scope with their circular
 	var dbCircularsId, dbAttachmentsId []uint64
-	var id uint64
+	var id, circularId uint64
+	// missingSince holds, as unix time, when the stored circulars already marked as missing were first missed
+	missingSince := make(map[uint64]int64)
+	var missing sql.NullInt64
+	// attachmentCircular maps each stored attachment to its circular
+	attachmentCircular := make(map[uint64]uint64)
+	cond, args := scope.where(parsedCircId)
+	col := columns
+	queryAttachments := "SELECT a.`" + col.attachmentId + "` id, a.`" + col.attachmentCircularId + "` FROM circolare_allegato a ORDER BY id DESC"
+	if cond != "" {
+		queryAttachments = "SELECT a.`" + col.attachmentId + "` id, a.`" + col.attachmentCircularId + "` FROM circolare_allegato a JOIN circolare c ON c.`" + col.id + "` = a.`" + col.attachmentCircularId + "`" + cond + " ORDER BY id DESC"
+	}
+
+	// missing_since is only needed with a grace period
+	queryMissing := "NULL"
+	if grace > 0 {
+		queryMissing = "UNIX_TIMESTAMP(c.`" + col.missingSince + "`)"
+	}
 
 	//TODO use multipleResultSets query to improve perfomance
-	rowsCirculars, errC := tx.Query("SELECT id FROM circolare ORDER BY id DESC")
-	if errC != nil {
-		log.Fatal(errC)
+	rowsCirculars, err := tx.QueryContext(ctx, "SELECT c.`"+col.id+"` id, "+queryMissing+" FROM circolare c"+cond+" ORDER BY id DESC", args...)
+	if err != nil {
+		return 0, 0, err
 	}
 	defer rowsCirculars.Close()
 	for rowsCirculars.Next() {
-		if err := rowsCirculars.Scan(&id); err != nil {
-			log.Fatal(err)
+		if err := rowsCirculars.Scan(&id, &missing); err != nil {
+			return 0, 0, err
 		}
 		dbCircularsId = append(dbCircularsId, id)
+		if missing.Valid {
+			missingSince[id] = missing.Int64
+		}
+	}
+	if err := rowsCirculars.Err(); err != nil {
+		return 0, 0, err
 	}
 
-	rowsAttachments, errA := tx.Query("SELECT id_allegato id FROM circolare_allegato ORDER BY id DESC")
-	if errA != nil {
-		log.Fatal(errA)
+	rowsAttachments, err := tx.QueryContext(ctx, queryAttachments, args...)
+	if err != nil {
+		return 0, 0, err
 	}
 	defer rowsAttachments.Close()
 	for rowsAttachments.Next() {
-		if err := rowsAttachments.Scan(&id); err != nil {
-			log.Fatal(err)
+		if err := rowsAttachments.Scan(&id, &circularId); err != nil {
+			return 0, 0, err
 		}
 		dbAttachmentsId = append(dbAttachmentsId, id)
+		attachmentCircular[id] = circularId
+	}
+	if err := rowsAttachments.Err(); err != nil {
+		return 0, 0, err
 	}
 
 	// Search db ids that weren't parsed
-	var idsCircToRemove, idsAttachToRemove []uint64
-	for _, id := range dbCircularsId {
-		if idx := sort.Search(len(parsedCircId), func(i int) bool { return parsedCircId[i] <= id }); parsedCircId[idx] != id {
-			idsCircToRemove = append(idsCircToRemove, id)
-		}
+	idsCircToRemove := idsToRemove(dbCircularsId, parsedCircId)
+	idsAttachToRemove := idsToRemove(dbAttachmentsId, parsedAttachId)
+
+	// Every row skipped or filtered out would look like a website without circulars
+	if len(parsedCircId) == 0 && len(dbCircularsId) > 0 {
+		return 0, 0, fmt.Errorf("%w: nothing was parsed, all the %d stored circulars would be removed", errCleanupRefused, len(dbCircularsId))
+	}
+	if maxDeletePercent > 0 && len(idsCircToRemove)*100 > maxDeletePercent*len(dbCircularsId) {
+		return 0, 0, fmt.Errorf("%w: %d of the %d stored circulars would be removed, more than %d%%", errCleanupRefused, len(idsCircToRemove), len(dbCircularsId), maxDeletePercent)
 	}
-	for _, id := range dbAttachmentsId {
-		if idx := sort.Search(len(parsedAttachId), func(i int) bool { return parsedAttachId[i] <= id }); parsedAttachId[idx] != id {
-			idsAttachToRemove = append(idsAttachToRemove, id)
+
+	if grace > 0 {
+		// Circulars parsed again aren't missing anymore
+		var idsCircFound []uint64
+		for _, id := range parsedCircId {
+			if _, ok := missingSince[id]; ok {
+				idsCircFound = append(idsCircFound, id)
+			}
+		}
+		if _, err := execByIds(ctx, tx, "UPDATE circolare SET `"+col.missingSince+"` = NULL WHERE `"+col.id+"` IN", idsCircFound); err != nil {
+			return 0, 0, err
+		}
+
+		// Only the circulars missing for longer than grace are deleted, the others are marked or kept marked
+		var idsCircExpired, idsCircNewlyMissing []uint64
+		held := make(map[uint64]bool)
+		expiredBefore := time.Now().Add(-grace).Unix()
+		for _, id := range idsCircToRemove {
+			since, ok := missingSince[id]
+			switch {
+			case !ok:
+				idsCircNewlyMissing = append(idsCircNewlyMissing, id)
+				held[id] = true
+			case since > expiredBefore:
+				held[id] = true
+			default:
+				idsCircExpired = append(idsCircExpired, id)
+			}
+		}
+		if _, err := execByIds(ctx, tx, "UPDATE circolare SET `"+col.missingSince+"` = NOW() WHERE `"+col.id+"` IN", idsCircNewlyMissing); err != nil {
+			return 0, 0, err
+		}
+		if len(held) > 0 {
+			log.Printf("INFO: %d missing circulars are kept until they've been missing for %v", len(held), grace)
+		}
+
+		// The attachments of the kept circulars are kept too
+		var idsAttachExpired []uint64
+		for _, id := range idsAttachToRemove {
+			if !held[attachmentCircular[id]] {
+				idsAttachExpired = append(idsAttachExpired, id)
+			}
 		}
+		idsCircToRemove, idsAttachToRemove = idsCircExpired, idsAttachExpired
 	}
 
-	// Delete removed circulars
-	for _, id := range idsAttachToRemove {
-		tx.Exec("DELETE FROM `circolare_allegato` WHERE id_allegato = ?", id)
+	// Delete removed circulars, any error rolls back the whole cleanup
+	deletedAttachments, err := deleteByIds(ctx, tx, "circolare_allegato", col.attachmentId, idsAttachToRemove)
+	if err != nil {
+		return 0, 0, err
 	}
-	for _, id := range idsCircToRemove {
-		tx.Exec("DELETE FROM `circolare` WHERE id = ?", id)
+	deletedCirculars, err := deleteByIds(ctx, tx, "circolare", col.id, idsCircToRemove)
+	if err != nil {
+		return 0, 0, err
 	}
 
 	if err := tx.Commit(); err != nil {
 		return 0, 0, err
 	}
 
-	return len(idsCircToRemove), len(idsAttachToRemove), nil
+	// The deleted rows are the authoritative count, a difference means the rows changed meanwhile or the ids aren't unique
+	log.Printf("INFO: identified %d circulars and %d attachments to remove", len(idsCircToRemove), len(idsAttachToRemove))
+	if deletedCirculars != int64(len(idsCircToRemove)) || deletedAttachments != int64(len(idsAttachToRemove)) {
+		log.Printf("WARNING: deleted %d circulars and %d attachments, but %d and %d were identified", deletedCirculars, deletedAttachments, len(idsCircToRemove), len(idsAttachToRemove))
+	}
+	metricDeletedCirculars.Add(deletedCirculars)
+	metricDeletedAttachments.Add(deletedAttachments)
+
+	return int(deletedCirculars), int(deletedAttachments), nil
+}
+
+// type worker holds what's needed to execute a work cycle.
+// Cycles can be started both by the scheduler in main and by the HTTP endpoints
+type worker struct {
+	// mu prevents cycles from overlapping
+	mu     sync.Mutex
+	client *http.Client
+	db     *sql.DB
+	// readDB serves the queries of the HTTP endpoints, it's db when there's no read replica
+	readDB *sql.DB
+	// siteUrls contains the circulars page of each school
+	siteUrls []string
+	// concurrency is the max number of schools processed in parallel
+	concurrency int
+	// cycleTimeout is the deadline of each cycle, 0 for none
+	cycleTimeout time.Duration
+	// breakers stop fetching from each school while its "segreteria digitale" keeps failing
+	breakers breakerSet
+	// notifier receives the new circulars, nil when notifications are disabled
+	notifier notifier
+	// downloader saves the attachments, nil when downloads are disabled
+	downloader *downloader
+	// prober stores the type and size of the attachments, nil when disabled
+	prober *attachmentProber
+	// duplicates flags the circulars published again with another id, nil when disabled
+	duplicates *duplicateDetection
+	// queue keeps the circulars whose insert failed until they're inserted, nil when disabled
+	queue *writeAheadQueue
+	// cleanupScope limits the stored circulars compared during cleanup
+	cleanupScope cleanupScope
+	// deleteGrace is how long a circular must be missing before it's deleted
+	deleteGrace time.Duration
+	// maxDeletePercent refuses the cleanups removing more than this percent of the stored circulars in scope, 0 for no limit
+	maxDeletePercent int
+	// cleanupOnly skips the insert, the cycles only fetch, parse and clean up. Used by -cleanup-only
+	cleanupOnly bool
+	// shouldUpdate chooses which of the already stored circulars get updated
+	shouldUpdate conflictStrategy
+	// resyncOnCleanup updates every stored circular during the cleanup cycles, ignoring shouldUpdate
+	resyncOnCleanup bool
+	// validUntilInclusive makes a circular valid through its valid until day, otherwise only up to its start
+	validUntilInclusive bool
+	// proxyAttachments enables /attachments/{id}
+	proxyAttachments bool
+	// adminEndpoints enables the endpoints hiding and restoring circulars, they require CIRCULARS_ADMIN_TOKEN
+	adminEndpoints bool
+	// refresh shares a single cycle among the concurrent /refresh requests, nil when each one runs its own
+	refresh *refreshFlight
+	// cache keeps the most recent stored circulars after the last successful cycle for /circulars and /feed, nil when disabled
+	cache *circularsCache
+	// storeRejected records the circulars skipped while parsing in circolare_scartata
+	storeRejected bool
+	// cleanupOnInsertFailure lets the cleanup run when a school was fetched and parsed but its insert failed
+	cleanupOnInsertFailure bool
+	fetchOpts              fetchOptions
+	parseOpts              parseOptions
+	// transformers are applied in order to the parsed circulars, before they're inserted
+	transformers []transformer
+
+	// fulltextMinToken is the min length of the words in the FULLTEXT index, 0 when searches don't use it
+	fulltextMinToken int
+	// stateMu guards the state read by the HTTP endpoints while a cycle is running
+	stateMu   sync.Mutex
+	lastCycle time.Time
+	stats     *statsCache
+}
+
+// lastCycleTime returns when the last successful cycle ended, the zero time if none did
+func (w *worker) lastCycleTime() time.Time {
+	w.stateMu.Lock()
+	defer w.stateMu.Unlock()
+	return w.lastCycle
+}
+
+// type cycleResult contains the counts produced by a work cycle
+type cycleResult struct {
+	Parsed             int `json:"parsed"`
+	Inserted           int `json:"inserted"`
+	Updated            int `json:"updated"`
+	RemovedCirculars   int `json:"removed_circulars"`
+	RemovedAttachments int `json:"removed_attachments"`
+	// cleanupAttempted is true when the cycle reached the cleanup step
+	cleanupAttempted bool
+}
+
+// setLastCycle records that a cycle has just updated the DB
+func (w *worker) setLastCycle() {
+	w.stateMu.Lock()
+	defer w.stateMu.Unlock()
+	w.lastCycle = time.Now().UTC()
+}
+
+// type schoolResult contains what a work cycle produced for a single school
+type schoolResult struct {
+	siteUrl   string
+	expected  int
+	parsed    int
+	inserted  int
+	updated   int
+	circulars []circular
+	durations stageDurations
+	err       error
+	// insertFailed is true when err comes from the insert, so circulars is still the complete parse of the school
+	insertFailed bool
+}
+
+// type stageDurations contains how long each stage of a cycle took
+type stageDurations struct {
+	fetch  time.Duration
+	parse  time.Duration
+	insert time.Duration
+	delete time.Duration
+}
+
+// add sums the durations of o to d
+func (d *stageDurations) add(o stageDurations) {
+	d.fetch += o.fetch
+	d.parse += o.parse
+	d.insert += o.insert
+	d.delete += o.delete
+}
+
+// processSchool gets, parses and inserts in the DB the circulars of a single school, in its own transaction
+func (w *worker) processSchool(ctx context.Context, siteUrl string, shouldUpdate conflictStrategy) (res schoolResult) {
+	res.siteUrl = siteUrl
+
+	// Get Circulars to parse
+	breaker := w.breakers[siteUrl]
+	if !breaker.allow() {
+		res.err = errBreakerOpen
+		return res
+	}
+	log.Printf("INFO: getting circulars from %s", siteUrl)
+	start := time.Now()
+	circularsHtml, expected, err := getCirculars(ctx, w.client, siteUrl, w.fetchOpts)
+	res.durations.fetch = time.Since(start)
+	metricFetchDuration.observe(res.durations.fetch)
+	if err != nil {
+		// Nothing is touched during a planned downtime, the breaker still pauses the requests if it lasts
+		if errors.Is(err, errMaintenance) {
+			log.Printf("WARNING: %s is in maintenance, skipping it until the next cycle", siteUrl)
+		}
+		breaker.failure()
+		res.err = err
+		return res
+	}
+	breaker.success()
+	res.expected = expected
+
+	// Parse circulars, unless the cycle is already out of time
+	if err := ctx.Err(); err != nil {
+		res.err = err
+		return res
+	}
+	log.Printf("INFO: parsing circulars from %s", siteUrl)
+	start = time.Now()
+	circulars, parseErrors, err := parseCirculars(circularsHtml, w.parseOpts)
+	res.durations.parse = time.Since(start)
+	metricParseDuration.observe(res.durations.parse)
+	if err != nil {
+		res.err = err
+		return res
+	}
+	res.parsed = len(circulars)
+	log.Printf("INFO: parsed %d circulars from %s", res.parsed, siteUrl)
+	if len(parseErrors) > 0 {
+		log.Printf("WARNING: skipped %d circulars from %s, %s", len(parseErrors), siteUrl, summarizeParseErrors(parseErrors))
+		// A failure doesn't fail the cycle, the skipped circulars are already in the log
+		if w.storeRejected {
+			if err := storeRejected(ctx, w.db, siteUrl, parseErrors); err != nil {
+				log.Printf("ERROR: can't store the skipped circulars from %s: %v", siteUrl, err)
+			}
+		}
+	}
+
+	// A gap means that some circulars have been skipped while parsing
+	if expected > 0 && expected != res.parsed {
+		log.Printf("WARNING: server reported %d circulars but %d were parsed from %s", expected, res.parsed, siteUrl)
+	}
+
+	for i := range circulars {
+		if circulars[i].Url, err = circularUrl(siteUrl, circulars[i].Id); err != nil {
+			res.err = err
+			return res
+		}
+	}
+
+	// Circulars removed by the transformers are neither inserted nor kept during cleanup
+	transformed := applyTransformers(circulars, w.transformers)
+	if len(transformed) != len(circulars) {
+		log.Printf("INFO: %d circulars removed by the transformers", len(circulars)-len(transformed))
+	}
+	res.circulars = transformed
+	if w.cleanupOnly {
+		return res
+	}
+
+	// Updates DB
+	log.Printf("INFO: updating DB")
+	start = time.Now()
+	// What's new is determined again by each attempt, as a failed one persisted nothing
+	var newCirculars []circular
+	var updated int
+	for attempt := 1; ; attempt++ {
+		newCirculars, updated, err = insertCirculars(ctx, w.db, res.circulars, shouldUpdate)
+		var commitErr *commitError
+		if err == nil || !errors.As(err, &commitErr) || attempt == insertAttempts || ctx.Err() != nil {
+			break
+		}
+		log.Printf("WARNING: %v, retrying the transaction (%d/%d)", err, attempt, insertAttempts)
+	}
+	res.durations.insert = time.Since(start)
+	metricInsertDuration.observe(res.durations.insert)
+	if err != nil {
+		res.err = err
+		res.insertFailed = true
+		// The parse isn't lost, the queue is drained once the DB is back
+		if w.queue != nil {
+			if err := w.queue.push(siteUrl, res.circulars); err != nil {
+				log.Printf("ERROR: can't queue the circulars from %s: %v", siteUrl, err)
+			} else {
+				log.Printf("INFO: queued %d circulars from %s", len(res.circulars), siteUrl)
+			}
+		}
+		return res
+	}
+	res.inserted, res.updated = len(newCirculars), updated
+	metricInsertedCirculars.Add(int64(res.inserted))
+	metricUpdatedCirculars.Add(int64(res.updated))
+	log.Printf("INFO: updated DB, %d new and %d updated circulars from %s", res.inserted, res.updated, siteUrl)
+
+	// Notifications are sent only for committed circulars, a failure doesn't fail the cycle
+	if w.notifier != nil && len(newCirculars) > 0 {
+		if err := w.notifier.notify(ctx, newCirculars); err != nil {
+			log.Printf("ERROR: %v", err)
+		} else {
+			metricNotifiedCirculars.Add(int64(len(newCirculars)))
+		}
+	}
+
+	// Duplicates are only flagged, a failure doesn't fail the cycle
+	if w.duplicates != nil {
+		if duplicates := w.duplicates.find(res.circulars); len(duplicates) > 0 {
+			if err := w.duplicates.store(ctx, w.db, duplicates); err != nil {
+				log.Printf("ERROR: can't store the duplicates: %v", err)
+			}
+		}
+	}
+
+	// Attachments without a type are probed, failures don't fail the cycle
+	if w.prober != nil {
+		probed, failed, err := w.prober.probeAll(ctx, w.db, siteUrl, res.circulars)
+		if err != nil {
+			log.Printf("ERROR: can't probe the attachments: %v", err)
+		} else {
+			log.Printf("INFO: probed %d attachments, %d failed", probed, failed)
+		}
+	}
+
+	// Attachments not downloaded yet are saved, failures don't fail the cycle
+	if w.downloader != nil {
+		downloaded, failed, skipped := w.downloader.downloadAll(ctx, siteUrl, res.circulars)
+		log.Printf("INFO: downloaded %d attachments, %d failed, %d skipped", downloaded, failed, skipped)
+	}
+
+	return res
+}
+
+// recoverPanic, when deferred, turns a panic into an error stored in err, logging it with the stack trace.
+// Fatal conditions must exit explicitly, as panics don't stop the process
+func recoverPanic(where string, err *error) {
+	if p := recover(); p != nil {
+		metricPanics.Add(1)
+		log.Printf("ERROR: panic in %s: %v\n%s", where, p, debug.Stack())
+		*err = fmt.Errorf("panic in %s: %v", where, p)
+	}
+}
+
+// runCycle gets, parses and inserts the circulars of every school in the DB, up to 'concurrency' schools in parallel.
+// A failing school doesn't stop the others.
+// When cleanup is true, it also removes from the DB the deleted circulars, but only if every school succeeded,
+// otherwise the circulars of the failed ones would be deleted. With resyncOnCleanup, cleanup cycles update every circular too.
+// With cleanupOnInsertFailure, a school whose insert failed doesn't block the cleanup: its parse is complete,
+// so its circulars are kept, while a failed fetch or parse still blocks it. The cycle still returns the insert error
+func (w *worker) runCycle(cleanup bool) (res cycleResult, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// Fetch, parse and DB work are cancelled once the cycle exceeds its deadline
+	ctx := context.Background()
+	if w.cycleTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, w.cycleTimeout)
+		defer cancel()
+	}
+
+	// Log where the time went, whatever the outcome
+	start := time.Now()
+	var durations stageDurations
+	defer func() {
+		if ctx.Err() == context.DeadlineExceeded {
+			log.Printf("ERROR: cycle cancelled, it exceeded its deadline of %v", w.cycleTimeout)
+		}
+		elapsed := time.Since(start)
+		metricCycleDuration.observe(elapsed)
+		log.Printf("INFO: cycle took %v (fetch %v, parse %v, insert %v, delete %v)", elapsed, durations.fetch, durations.parse, durations.insert, durations.delete)
+	}()
+
+	// The batches queued by the failed inserts, also before a restart, go first so they don't overwrite newer values
+	if w.queue != nil && !w.cleanupOnly {
+		w.drainQueue(ctx)
+	}
+
+	// Cleanup cycles can reconcile every circular, catching the edits to the ones outside the update window
+	shouldUpdate := w.shouldUpdate
+	if cleanup && w.resyncOnCleanup {
+		log.Printf("INFO: full re-sync, updating every circular")
+		shouldUpdate = upsertAll
+	}
+
+	results := make([]schoolResult, len(w.siteUrls))
+	sem := make(chan struct{}, w.concurrency)
+	var wg sync.WaitGroup
+	for i, siteUrl := range w.siteUrls {
+		wg.Add(1)
+		go func(i int, siteUrl string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			// A panic in a goroutine can't be recovered by the caller, it fails only this school
+			results[i].siteUrl = siteUrl
+			defer recoverPanic(siteUrl, &results[i].err)
+			results[i] = w.processSchool(ctx, siteUrl, shouldUpdate)
+		}(i, siteUrl)
+	}
+	wg.Wait()
+
+	// Aggregate the results
+	var circulars []circular
+	var expected int
+	var failed []schoolResult
+	blocking := 0
+	for _, r := range results {
+		res.Parsed += r.parsed
+		res.Inserted += r.inserted
+		res.Updated += r.updated
+		expected += r.expected
+		durations.add(r.durations)
+		if r.err != nil {
+			failed = append(failed, r)
+			if !r.insertFailed || !w.cleanupOnInsertFailure {
+				blocking++
+				continue
+			}
+		}
+		circulars = append(circulars, r.circulars...)
+	}
+
+	metricExpectedCirculars.Set(int64(expected))
+	metricParsedCirculars.Set(int64(res.Parsed))
+	if expected > 0 {
+		metricParsingGap.Set(int64(expected - res.Parsed))
+	}
+
+	var cycleErr error
+	if len(failed) == 1 && len(results) == 1 {
+		cycleErr = failed[0].err
+	} else if len(failed) > 0 {
+		for _, r := range failed {
+			log.Printf("ERROR: %s: %v", r.siteUrl, r.err)
+		}
+		cycleErr = fmt.Errorf("%d of %d schools failed", len(failed), len(results))
+	}
+	if cycleErr == nil {
+		w.setLastCycle()
+		// The primary is read, the replica could lag
+		if err := w.cache.fill(w.db); err != nil {
+			log.Printf("ERROR: can't fill the cache: %v", err)
+		}
+	} else {
+		w.cache.invalidate()
+	}
+	if !cleanup || blocking > 0 {
+		return res, cycleErr
+	}
+	if cycleErr != nil {
+		log.Printf("WARNING: cleaning up even though the insert failed, the parsed circulars are complete")
+	}
+	res.cleanupAttempted = true
+
+	log.Printf("INFO: removing deleted circulars")
+	deleteStart := time.Now()
+	res.RemovedCirculars, res.RemovedAttachments, err = deleteRemovedCirculars(ctx, w.db, circulars, w.cleanupScope, w.deleteGrace, w.maxDeletePercent)
+	durations.delete = time.Since(deleteStart)
+	metricDeleteDuration.observe(durations.delete)
+	if err != nil {
+		return res, err
+	}
+	log.Printf("INFO: removed %d circulars and %d attachments", res.RemovedCirculars, res.RemovedAttachments)
+	if res.RemovedCirculars > 0 && cycleErr == nil {
+		if err := w.cache.fill(w.db); err != nil {
+			log.Printf("ERROR: can't fill the cache: %v", err)
+		}
+	}
+	if w.parseOpts.keepRawHtml {
+		purged, err := purgeOrphanRawHtml(ctx, w.db)
+		if err != nil {
+			return res, err
+		}
+		log.Printf("INFO: removed the html of %d circulars", purged)
+	}
+	if w.duplicates != nil {
+		purged, err := purgeOrphanDuplicates(ctx, w.db)
+		if err != nil {
+			return res, err
+		}
+		log.Printf("INFO: removed %d links between duplicates", purged)
+	}
+
+	return res, cycleErr
+}
+
+// lookupEnvInt returns the int value of the optional env variable, def when it's not set.
+// Exits when the value isn't a parsable int
+func lookupEnvInt(name string, def int) int {
+	envVar, exists := os.LookupEnv(name)
+	if !exists {
+		return def
+	}
+	i, err := strconv.Atoi(envVar)
+	if err != nil {
+		log.Fatalf("ERROR: %s isn't a parsable int", name)
+	}
+	return i
+}
+
+// lookupEnvBool returns the bool value of the optional env variable, def when it's not set.
+// Exits when the value isn't a parsable bool
+func lookupEnvBool(name string, def bool) bool {
+	envVar, exists := os.LookupEnv(name)
+	if !exists {
+		return def
+	}
+	b, err := strconv.ParseBool(envVar)
+	if err != nil {
+		log.Fatalf("ERROR: %s isn't a parsable bool", name)
+	}
+	return b
+}
+
+// lookupEnvStrictness returns whether CIRCULARS_PARSE_STRICTNESS is lenient, the default is strict
+func lookupEnvStrictness() bool {
+	switch envVar := os.Getenv("CIRCULARS_PARSE_STRICTNESS"); envVar {
+	case "", "strict":
+		return false
+	case "lenient":
+		log.Printf("INFO: lenient parsing, missing labels fall back to the span positions")
+		return true
+	}
+	log.Fatal("ERROR: CIRCULARS_PARSE_STRICTNESS must be either strict or lenient")
+	return false
+}
+
+// lookupParseOptions returns the parsing options set by the env variables, along with the name of the locale
+func lookupParseOptions() (opts parseOptions, localeName string) {
+	localeName = defaultLocale
+	if envVar, exists := os.LookupEnv("CIRCULARS_LOCALE"); exists {
+		localeName = envVar
+	}
+	loc, exists := locales[localeName]
+	if !exists {
+		log.Fatalf("ERROR: CIRCULARS_LOCALE %q isn't a supported locale", localeName)
+	}
+	startMonth := lookupEnvInt("CIRCULARS_SCHOOL_YEAR_START_MONTH", int(defaultSchoolYearStartMonth))
+	if startMonth < 1 || startMonth > 12 {
+		log.Fatal("ERROR: CIRCULARS_SCHOOL_YEAR_START_MONTH must be between 1 and 12")
+	}
+
+	return parseOptions{
+		locale:                    loc,
+		lenient:                   lookupEnvStrictness(),
+		collectExtra:              lookupEnvBool("CIRCULARS_COLLECT_EXTRA", false),
+		keepRawHtml:               lookupEnvBool("CIRCULARS_STORE_RAW_HTML", false),
+		mergeDuplicateAttachments: lookupEnvBool("CIRCULARS_MERGE_DUPLICATE_ATTACHMENTS", false),
+		maxAttachmentTitleLen:     lookupEnvInt("CIRCULARS_MAX_ATTACHMENT_TITLE_LENGTH", 255),
+		maxTitleLen:               lookupEnvInt("CIRCULARS_MAX_TITLE_LENGTH", 255),
+		maxCategoryLen:            lookupEnvInt("CIRCULARS_MAX_CATEGORY_LENGTH", 255),
+		schoolYearStartMonth:      time.Month(startMonth),
+	}, localeName
+}
+
+// lookupEnvDuration returns the Duration value of the optional env variable, def when it's not set.
+// Exits when the value isn't a parsable Duration
+func lookupEnvDuration(name string, def time.Duration) time.Duration {
+	envVar, exists := os.LookupEnv(name)
+	if !exists {
+		return def
+	}
+	d, err := time.ParseDuration(envVar)
+	if err != nil {
+		log.Fatalf("ERROR: %s isn't a parsable Duration", name)
+	}
+	return d
 }
 
 // Main function get the configuration from env variables and the execute the worker cycle.
 // get circulars -> parse circulars -> update DB
 // On a lower frequency it also remove from the DB deleted circulars
 func main() {
+	printVersion := flag.Bool("version", false, "print version and build info, then exit")
+	selftest := flag.Bool("selftest", false, "parse the bundled fixture without network nor DB, then exit")
+	printConfig := flag.Bool("print-config", false, "print the resolved configuration as JSON, with the secrets redacted, then exit")
+	importFile := flag.String("import-jsonl", "", "insert the circulars of the file, a JSON circular per line, then exit")
+	parseFileName := flag.String("parse-file", "", "print as JSON the circulars parsed from a saved response, without network nor DB, then exit")
+	reprocessDir := flag.String("reprocess", "", "parse again the responses saved in the directory and compare them with the DB, then exit")
+	reprocessWrite := flag.Bool("reprocess-write", false, "with -reprocess, insert the circulars missing from the DB")
+	cleanupOnly := flag.Bool("cleanup-only", false, "fetch and parse the circulars, then only remove the ones deleted from the website, without inserting. Prints the removed counts and exits")
+	reportFormat := flag.String("report", "", "print the stored circulars per category and per month, as text or json, then exit")
+	flag.Parse()
+	if *printVersion {
+		fmt.Println(versionString())
+		os.Exit(0)
+	}
+	if *selftest {
+		if err := runSelftest(); err != nil {
+			fmt.Printf("FAIL: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	// The selected profile only sets the variables missing from the environment, before anything reads them
+	profileName, profileSelected := os.LookupEnv("CIRCULARS_PROFILE")
+	profileSet := 0
+	if profileSelected {
+		profilesFile, exists := os.LookupEnv("CIRCULARS_PROFILES_FILE")
+		if !exists {
+			log.Fatal("ERROR: CIRCULARS_PROFILES_FILE is required when CIRCULARS_PROFILE is set")
+		}
+		profile, err := loadProfile(profilesFile, profileName)
+		if err != nil {
+			log.Fatalf("ERROR: can't load CIRCULARS_PROFILES_FILE: %v", err)
+		}
+		if profileSet, err = applyProfile(profile); err != nil {
+			log.Fatalf("ERROR: can't apply profile %q: %v", profileName, err)
+		}
+	}
+	if *parseFileName != "" {
+		opts, _ := lookupParseOptions()
+		if err := parseFile(*parseFileName, opts, os.Stdout); err != nil {
+			log.Fatalf("ERROR: %v", err)
+		}
+		return
+	}
+
+	// Get the optional log file, logs go to stderr otherwise
+	if envVar, exists := os.LookupEnv("CIRCULARS_LOG_FILE"); exists {
+		logFile, err := openRotatingFile(envVar, int64(lookupEnvInt("CIRCULARS_LOG_MAX_SIZE", 10<<20)), lookupEnvInt("CIRCULARS_LOG_MAX_BACKUPS", 5))
+		if err != nil {
+			log.Fatalf("ERROR: can't open CIRCULARS_LOG_FILE: %v", err)
+		}
+		log.SetOutput(logFile)
+		defer logFile.Close()
+	}
+	log.Printf("INFO: starting %s", versionString())
+	if profileSelected {
+		log.Printf("INFO: using profile %s, %d variables set from it", profileName, profileSet)
+	}
+
+	// Stop at the next wait on SIGINT/SIGTERM, so the running cycle completes and everything is closed
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	// Get db configs
 	var connectionString string
-	if envVar, exists := os.LookupEnv("CIRCULARS_DB_CONNECTION_STRING"); exists {
+	if envVar, exists := os.LookupEnv("CIRCULARS_DB_CONNECTION_STRING_FILE"); exists {
+		// Docker/K8s secrets are mounted as files, so the password isn't exposed in the env
+		content, err := ioutil.ReadFile(envVar)
+		if err != nil {
+			log.Fatalf("ERROR: can't read CIRCULARS_DB_CONNECTION_STRING_FILE: %v", err)
+		}
+		connectionString = strings.TrimRight(string(content), "\r\n")
+	} else if envVar, exists := os.LookupEnv("CIRCULARS_DB_CONNECTION_STRING"); exists {
 		connectionString = envVar
 	} else {
 		// Try reading form filename received as cli argument
-		if argsLen := len(os.Args); argsLen < 2 {
+		if flag.NArg() < 1 {
 			log.Fatal("ERROR: Missing script argument -> ./circolari <sqlcredentials-path>")
 		}
-		sqlConfFilename := os.Args[1]
+		sqlConfFilename := flag.Arg(0)
 
 		// Load db config
 		dbConfig, err := loadConfiguration(sqlConfFilename)
@@ -369,13 +2290,106 @@ func main() {
 		connectionString = dbConfig.ConnectionString
 	}
 
-	// Get circulars siteUrl
-	var siteUrl string
+	// Get the names of the columns, when the tables don't use the default ones
+	if envVar, exists := os.LookupEnv("CIRCULARS_COLUMN_MAP"); exists {
+		m, err := parseColumnMapping(envVar)
+		if err != nil {
+			log.Fatalf("ERROR: CIRCULARS_COLUMN_MAP: %v", err)
+		}
+		columns = m
+	}
+
+	// Get the TLS settings of the HTTP and DB connections, secure by default
+	tlsMinVersion := "1.2"
+	if envVar, exists := os.LookupEnv("CIRCULARS_TLS_MIN_VERSION"); exists {
+		tlsMinVersion = envVar
+	}
+	tlsInsecure := lookupEnvBool("CIRCULARS_TLS_INSECURE_SKIP_VERIFY", false)
+	tlsConfig, err := newTLSConfig(tlsMinVersion, tlsInsecure)
+	if err != nil {
+		log.Fatalf("ERROR: CIRCULARS_TLS_MIN_VERSION: %v", err)
+	}
+	if connectionString, err = configureDBTLS(connectionString, tlsConfig); err != nil {
+		log.Fatalf("ERROR: invalid DB connection string: %v", err)
+	}
+	// The HTTP endpoints can read from a replica, the cycles always write to the primary
+	readConnectionString := os.Getenv("CIRCULARS_DB_READ_CONNECTION_STRING")
+	if readConnectionString != "" {
+		if readConnectionString, err = configureDBTLS(readConnectionString, tlsConfig); err != nil {
+			log.Fatalf("ERROR: invalid CIRCULARS_DB_READ_CONNECTION_STRING: %v", err)
+		}
+	}
+
+	// Importing only needs the DB
+	if *importFile != "" {
+		db, err := sql.Open(dbDriver, connectionString)
+		if err != nil {
+			log.Fatalf("ERROR: %v", err)
+		}
+		defer db.Close()
+		inserted, updated, skipped, err := importJSONL(db, *importFile)
+		log.Printf("INFO: imported %d new circulars, updated %d, skipped %d lines", inserted, updated, skipped)
+		if err != nil {
+			log.Fatalf("ERROR: import failed: %v", err)
+		}
+		return
+	}
+	if *reportFormat != "" {
+		if *reportFormat != "text" && *reportFormat != "json" {
+			log.Fatal("ERROR: -report must be either text or json")
+		}
+		db, err := sql.Open(dbDriver, connectionString)
+		if err != nil {
+			log.Fatalf("ERROR: %v", err)
+		}
+		defer db.Close()
+		r, err := queryReport(db)
+		if err != nil {
+			log.Fatalf("ERROR: can't compute the report: %v", err)
+		}
+		if err := r.write(os.Stdout, *reportFormat); err != nil {
+			log.Fatalf("ERROR: %v", err)
+		}
+		return
+	}
+
+	// Get circulars siteUrl of each school
+	var siteUrls []string
 	if envVar, exists := os.LookupEnv("CIRCULARS_SITE_URL"); exists {
-		siteUrl = envVar
-	} else {
+		for _, siteUrl := range strings.Split(envVar, ",") {
+			if siteUrl = strings.TrimSpace(siteUrl); siteUrl != "" {
+				siteUrls = append(siteUrls, siteUrl)
+			}
+		}
+	}
+	if len(siteUrls) == 0 {
 		log.Fatal("ERROR: Missing CIRCULARS_SITE_URL env variable")
 	}
+	for _, siteUrl := range siteUrls {
+		if _, err := circularUrl(siteUrl, 0); err != nil {
+			log.Fatalf("ERROR: invalid CIRCULARS_SITE_URL %q: %v", siteUrl, err)
+		}
+	}
+
+	// Get how many schools are processed in parallel
+	concurrency := lookupEnvInt("CIRCULARS_CONCURRENCY", 4)
+	if concurrency < 1 {
+		log.Fatal("ERROR: CIRCULARS_CONCURRENCY must be at least 1")
+	}
+
+	// Get the optional cron schedule, when set it replaces the fixed interval between work cycles
+	var schedule *cronSchedule
+	if envVar, exists := os.LookupEnv("CIRCULARS_CRON"); exists {
+		s, err := parseCron(envVar)
+		if err != nil {
+			log.Fatalf("ERROR: CIRCULARS_CRON isn't a valid cron expression: %v", err)
+		}
+		if s.next(time.Now()).IsZero() {
+			log.Fatal("ERROR: CIRCULARS_CRON never matches")
+		}
+		log.Printf("INFO: scheduling with cron expression %q", envVar)
+		schedule = s
+	}
 
 	// Get minutes between work cycles
 	var parseTimeout time.Duration
@@ -386,56 +2400,541 @@ func main() {
 		} else {
 			log.Fatal("ERROR: CIRCULARS_CYCLE_WAIT isn't a parsable Duration")
 		}
-	} else {
+	} else if schedule == nil {
 		log.Fatal("ERROR: Missing CIRCULARS_CYCLE_WAIT env variable")
 	}
 
-	// First time execute without waiting
-	nextTime := time.Now().UTC()
-	nextCleanupTime := nextTime
-	for {
-		// Wait for next round
-		time.Sleep(time.Until(nextTime))
-		nextTime = nextTime.Truncate(time.Minute).Add(parseTimeout)
+	// Get the deadline of each cycle, by default a cycle must end before the next one is due
+	cycleTimeout := lookupEnvDuration("CIRCULARS_CYCLE_TIMEOUT", parseTimeout)
 
-		// Get Circulars to parse
-		log.Printf("INFO: getting circulars")
-		circularsHtml, err := getCirculars(siteUrl)
+	// Get the fetching options
+	fetchOpts := fetchOptions{
+		maxResponseBytes:  int64(lookupEnvInt("CIRCULARS_MAX_RESPONSE_BYTES", 64<<20)),
+		action:            "akSEARCH",
+		field:             "default",
+		errorSnippetBytes: lookupEnvInt("CIRCULARS_ERROR_SNIPPET_BYTES", 200),
+		tableWrap:         tableWrapAuto,
+	}
+	if envVar, exists := os.LookupEnv("CIRCULARS_TABLE_WRAP"); exists {
+		if envVar != tableWrapAuto && envVar != tableWrapAlways && envVar != tableWrapNever {
+			log.Fatal("ERROR: CIRCULARS_TABLE_WRAP must be one of auto, always or never")
+		}
+		fetchOpts.tableWrap = envVar
+	}
+	if envVar, exists := os.LookupEnv("CIRCULARS_SEARCH_ACTION"); exists {
+		fetchOpts.action = envVar
+	}
+	if envVar, exists := os.LookupEnv("CIRCULARS_SEARCH_FIELD"); exists {
+		fetchOpts.field = envVar
+	}
+	fetchOpts.mode = fetchModePost
+	if envVar, exists := os.LookupEnv("CIRCULARS_FETCH_MODE"); exists {
+		if envVar != fetchModePost && envVar != fetchModeGet {
+			log.Fatal("ERROR: CIRCULARS_FETCH_MODE must be either post or get")
+		}
+		fetchOpts.mode = envVar
+	}
+	if envVar, exists := os.LookupEnv("CIRCULARS_DEBUG_CAPTURE_DIR"); exists {
+		log.Printf("WARNING: capturing every response in %s, the files aren't cleaned up", envVar)
+		fetchOpts.captureDir = envVar
+	}
+	if fetchOpts.maxResponseBytes <= 0 {
+		log.Fatal("ERROR: CIRCULARS_MAX_RESPONSE_BYTES must be positive")
+	}
+
+	// Get the locale and the parsing options
+	parseOpts, localeName := lookupParseOptions()
+	loc := parseOpts.locale
+
+	// Get the optional published date range, with the same layout of the circulars dates
+	var minDate, maxDate time.Time
+	if envVar, exists := os.LookupEnv("CIRCULARS_MIN_DATE"); exists {
+		d, err := time.Parse(loc.dateLayout, envVar)
 		if err != nil {
-			log.Printf("ERROR: %v", err)
-			continue
+			log.Fatalf("ERROR: CIRCULARS_MIN_DATE isn't a parsable date (%s)", loc.dateLayout)
+		}
+		minDate = d
+	}
+	if envVar, exists := os.LookupEnv("CIRCULARS_MAX_DATE"); exists {
+		d, err := time.Parse(loc.dateLayout, envVar)
+		if err != nil {
+			log.Fatalf("ERROR: CIRCULARS_MAX_DATE isn't a parsable date (%s)", loc.dateLayout)
+		}
+		maxDate = d
+	}
+	if !minDate.IsZero() && !maxDate.IsZero() && minDate.After(maxDate) {
+		log.Fatal("ERROR: CIRCULARS_MIN_DATE is after CIRCULARS_MAX_DATE")
+	}
+
+	// Get the optional id floor, the older circulars are neither inserted nor deleted
+	var minId uint64
+	if envVar, exists := os.LookupEnv("CIRCULARS_MIN_ID"); exists {
+		if minId, err = strconv.ParseUint(envVar, 10, 64); err != nil {
+			log.Fatal("ERROR: CIRCULARS_MIN_ID isn't a parsable uint")
+		}
+	}
+
+	// Get the strategy for circulars that are already stored
+	strategy := defaultConflictStrategy
+	if envVar, exists := os.LookupEnv("CIRCULARS_INSERT_STRATEGY"); exists {
+		strategy = envVar
+	}
+	shouldUpdate, err := parseConflictStrategy(strategy, loc.dateLayout)
+	if err != nil {
+		log.Fatalf("ERROR: CIRCULARS_INSERT_STRATEGY: %v", err)
+	}
+	log.Printf("INFO: insert strategy set to %s", strategy)
+
+	// Get how updates reusing the id of an unrelated circular are detected
+	if envVar, exists := os.LookupEnv("CIRCULARS_ID_REUSE_THRESHOLD"); exists {
+		threshold, err := strconv.ParseFloat(envVar, 64)
+		if err != nil || threshold < 0 || threshold > 1 {
+			log.Fatal("ERROR: CIRCULARS_ID_REUSE_THRESHOLD must be a number between 0 and 1")
+		}
+		idReuse.threshold = threshold
+	}
+	idReuse.keepStored = lookupEnvBool("CIRCULARS_ID_REUSE_KEEP_STORED", false)
+
+	// Get how the circulars published twice are found, it's disabled by default
+	var duplicates *duplicateDetection
+	if envVar, exists := os.LookupEnv("CIRCULARS_DUPLICATE_THRESHOLD"); exists {
+		threshold, err := strconv.ParseFloat(envVar, 64)
+		if err != nil || threshold <= 0 || threshold > 1 {
+			log.Fatal("ERROR: CIRCULARS_DUPLICATE_THRESHOLD must be a number greater than 0, up to 1")
+		}
+		duplicates = &duplicateDetection{threshold: threshold, window: lookupEnvDuration("CIRCULARS_DUPLICATE_WINDOW", 7*24*time.Hour)}
+	}
+
+	// Get the transformers applied before inserting the circulars
+	var transformers []transformer
+	if minId > 0 {
+		transformers = append(transformers, minIdFilter(minId))
+	}
+	if !minDate.IsZero() || !maxDate.IsZero() {
+		transformers = append(transformers, publishedDateFilter(minDate, maxDate))
+	}
+	if lookupEnvBool("CIRCULARS_NORMALIZE_WHITESPACE", false) {
+		transformers = append(transformers, normalizeWhitespace)
+	}
+	// The categories are normalized first, so the filter sees their canonical names
+	categoryMap := make(map[string]string)
+	if envVar, exists := os.LookupEnv("CIRCULARS_CATEGORY_MAP"); exists {
+		if categoryMap, err = parseCategoryMap(envVar); err != nil {
+			log.Fatalf("ERROR: CIRCULARS_CATEGORY_MAP: %v", err)
 		}
+	}
+	categoryTitleCase := lookupEnvBool("CIRCULARS_CATEGORY_TITLE_CASE", false)
+	if len(categoryMap) > 0 || categoryTitleCase {
+		transformers = append(transformers, categoryNormalizer(categoryMap, categoryTitleCase))
+	}
+	if envVar, exists := os.LookupEnv("CIRCULARS_CATEGORIES"); exists {
+		transformers = append(transformers, categoryFilter(strings.Split(envVar, ",")))
+	}
 
-		// Parse circulars
-		log.Printf("INFO: parsing circulars")
-		circulars, err := parseCirculars(circularsHtml)
+	// Get where new circulars are notified
+	var notifier notifier
+	webhookUrl := os.Getenv("CIRCULARS_WEBHOOK_URL")
+	webhookOpts := webhookOptions{
+		secret:  os.Getenv("CIRCULARS_WEBHOOK_SECRET"),
+		retries: lookupEnvInt("CIRCULARS_WEBHOOK_RETRIES", 3),
+	}
+	if webhookOpts.retries < 0 {
+		log.Fatal("ERROR: CIRCULARS_WEBHOOK_RETRIES can't be negative")
+	}
+	if envVar, exists := os.LookupEnv("CIRCULARS_NOTIFY_ROUTES_FILE"); exists {
+		router, err := loadCategoryRouter(envVar, webhookUrl, webhookOpts)
 		if err != nil {
-			log.Printf("ERROR: %v", err)
-			continue
+			log.Fatalf("ERROR: can't load CIRCULARS_NOTIFY_ROUTES_FILE: %v", err)
+		}
+		notifier = router
+	} else if webhookUrl != "" {
+		notifier = newWebhookNotifier(webhookUrl, webhookOpts)
+	}
+
+	// Get the HTTP transport tuning
+	maxIdleConns := lookupEnvInt("CIRCULARS_HTTP_MAX_IDLE_CONNS", 10)
+	idleConnTimeout := lookupEnvDuration("CIRCULARS_HTTP_IDLE_CONN_TIMEOUT", 90*time.Second)
+	tlsHandshakeTimeout := lookupEnvDuration("CIRCULARS_HTTP_TLS_HANDSHAKE_TIMEOUT", 10*time.Second)
+	client := newHTTPClient(maxIdleConns, idleConnTimeout, tlsHandshakeTimeout, tlsConfig)
+
+	// Get the DB connections tuning
+	dbStartupTimeout := lookupEnvDuration("CIRCULARS_DB_STARTUP_TIMEOUT", time.Minute)
+	dbMaxIdleTime := lookupEnvDuration("CIRCULARS_DB_MAX_IDLE_TIME", 5*time.Minute)
+	dbPingInterval := lookupEnvDuration("CIRCULARS_DB_PING_INTERVAL", 0)
+	fulltext := lookupEnvBool("CIRCULARS_FULLTEXT", false)
+
+	// Get where attachments are downloaded, reusing the transport of the circulars requests
+	var attachmentsDownloader *downloader
+	if envVar, exists := os.LookupEnv("CIRCULARS_DOWNLOAD_DIR"); exists {
+		pathTemplate := defaultDownloadPath
+		if envVar, exists := os.LookupEnv("CIRCULARS_DOWNLOAD_PATH"); exists {
+			pathTemplate = envVar
+		}
+		maxPerCircular := lookupEnvInt("CIRCULARS_DOWNLOAD_MAX_PER_CIRCULAR", 0)
+		if maxPerCircular < 0 {
+			log.Fatal("ERROR: CIRCULARS_DOWNLOAD_MAX_PER_CIRCULAR can't be negative")
+		}
+		downloadConcurrency := lookupEnvInt("CIRCULARS_DOWNLOAD_CONCURRENCY", 2)
+		if downloadConcurrency <= 0 {
+			log.Fatal("ERROR: CIRCULARS_DOWNLOAD_CONCURRENCY must be positive")
+		}
+		attachmentsDownloader = newDownloader(client, envVar, pathTemplate, maxPerCircular, downloadConcurrency)
+		log.Printf("INFO: downloading attachments to %s", filepath.Join(envVar, filepath.FromSlash(pathTemplate)))
+	}
+
+	// Get where the circulars whose insert failed are queued
+	var queue *writeAheadQueue
+	if envVar, exists := os.LookupEnv("CIRCULARS_QUEUE_DIR"); exists {
+		queue = &writeAheadQueue{dir: envVar, maxBatches: lookupEnvInt("CIRCULARS_QUEUE_MAX_BATCHES", 100)}
+		if queue.maxBatches <= 0 {
+			log.Fatal("ERROR: CIRCULARS_QUEUE_MAX_BATCHES must be positive")
+		}
+	}
+
+	// Get whether the attachments are probed, also reusing the transport
+	var prober *attachmentProber
+	if lookupEnvBool("CIRCULARS_PROBE_ATTACHMENTS", false) {
+		probeConcurrency := lookupEnvInt("CIRCULARS_PROBE_CONCURRENCY", 4)
+		if probeConcurrency <= 0 {
+			log.Fatal("ERROR: CIRCULARS_PROBE_CONCURRENCY must be positive")
 		}
-		log.Printf("INFO: parsed %d circulars", len(circulars))
+		prober = newAttachmentProber(client, probeConcurrency)
+	}
+
+	// Get which stored circulars are compared during cleanup
+	scopeName := "all"
+	if envVar, exists := os.LookupEnv("CIRCULARS_CLEANUP_SCOPE"); exists {
+		scopeName = envVar
+	}
+	scope, err := parseCleanupScope(scopeName)
+	if err != nil {
+		log.Fatalf("ERROR: CIRCULARS_CLEANUP_SCOPE: %v", err)
+	}
+	// The circulars filtered out by id or published date aren't parsed, so they must not be compared
+	scope.minId = minId
+	scope.minDate, scope.maxDate = minDate, maxDate
+	deleteGrace := lookupEnvDuration("CIRCULARS_DELETE_GRACE", 0)
+	maxDeletePercent := lookupEnvInt("CIRCULARS_MAX_DELETE_PERCENT", 0)
+	if maxDeletePercent < 0 || maxDeletePercent > 100 {
+		log.Fatal("ERROR: CIRCULARS_MAX_DELETE_PERCENT must be between 0 and 100")
+	}
+	resyncOnCleanup := lookupEnvBool("CIRCULARS_CLEANUP_RESYNC", false)
+	cleanupOnInsertFailure := lookupEnvBool("CIRCULARS_CLEANUP_ON_INSERT_FAILURE", false)
+	cleanupOnStart := lookupEnvBool("CIRCULARS_CLEANUP_ON_START", false)
+	storeRejected := lookupEnvBool("CIRCULARS_STORE_REJECTED", true)
+
+	// Get when to stop fetching from a failing "segreteria digitale"
+	breakerThreshold := lookupEnvInt("CIRCULARS_BREAKER_THRESHOLD", 5)
+	breakerCooldown := lookupEnvDuration("CIRCULARS_BREAKER_COOLDOWN", 10*time.Minute)
+
+	// Get the HTTP server address, it's started only when an address is configured
+	httpAddr, httpEnabled := os.LookupEnv("CIRCULARS_HTTP_ADDR")
+	httpToken := os.Getenv("CIRCULARS_HTTP_TOKEN")
+	adminToken := os.Getenv("CIRCULARS_ADMIN_TOKEN")
+	if adminToken != "" && adminToken == httpToken {
+		log.Fatal("ERROR: CIRCULARS_ADMIN_TOKEN must differ from CIRCULARS_HTTP_TOKEN")
+	}
+	if httpEnabled && httpToken == "" {
+		log.Fatal("ERROR: CIRCULARS_HTTP_TOKEN is required when CIRCULARS_HTTP_ADDR is set")
+	}
+	statsTTL := lookupEnvDuration("CIRCULARS_STATS_TTL", 30*time.Second)
+	cacheSize := lookupEnvInt("CIRCULARS_CACHE_SIZE", 200)
+	proxyAttachments := lookupEnvBool("CIRCULARS_PROXY_ATTACHMENTS", false)
+	refreshShared := lookupEnvBool("CIRCULARS_REFRESH_SHARED", true)
+	validUntil := "inclusive"
+	if envVar, exists := os.LookupEnv("CIRCULARS_VALID_UNTIL"); exists {
+		validUntil = envVar
+	}
+	if validUntil != "inclusive" && validUntil != "exclusive" {
+		log.Fatal("ERROR: CIRCULARS_VALID_UNTIL must be either inclusive or exclusive")
+	}
+
+	// Get whether deletion is disabled, keeping an append-only store
+	disableDelete := lookupEnvBool("CIRCULARS_DISABLE_DELETE", false)
+	migrate := lookupEnvBool("CIRCULARS_MIGRATE", true)
+	shutdownTimeout := lookupEnvDuration("CIRCULARS_SHUTDOWN_TIMEOUT", 0)
+	maxConsecutiveFailures := lookupEnvInt("CIRCULARS_MAX_CONSECUTIVE_FAILURES", 0)
+	if maxConsecutiveFailures < 0 {
+		log.Fatal("ERROR: CIRCULARS_MAX_CONSECUTIVE_FAILURES can't be negative")
+	}
+	if disableDelete {
+		log.Printf("INFO: deletion of removed circulars is disabled")
+	}
 
-		// Updates DB
-		log.Printf("INFO: updating DB")
-		err = insertCirculars(circulars, 25, connectionString)
+	// Everything has been resolved, nothing has been connected yet
+	if *printConfig {
+		cfg := effectiveConfig{
+			DBConnectionString:        redactDSN(connectionString),
+			Profile:                   profileName,
+			DBReadConnectionString:    redactDSN(readConnectionString),
+			DBStartupTimeout:          dbStartupTimeout.String(),
+			DBMaxIdleTime:             dbMaxIdleTime.String(),
+			DBPingInterval:            dbPingInterval.String(),
+			ColumnMap:                 os.Getenv("CIRCULARS_COLUMN_MAP"),
+			SiteUrls:                  siteUrls,
+			Concurrency:               concurrency,
+			Cron:                      os.Getenv("CIRCULARS_CRON"),
+			CycleWait:                 parseTimeout.String(),
+			CycleTimeout:              cycleTimeout.String(),
+			FetchMode:                 fetchOpts.mode,
+			DebugCaptureDir:           fetchOpts.captureDir,
+			SearchAction:              fetchOpts.action,
+			SearchField:               fetchOpts.field,
+			MaxResponseBytes:          fetchOpts.maxResponseBytes,
+			ErrorSnippetBytes:         fetchOpts.errorSnippetBytes,
+			TableWrap:                 fetchOpts.tableWrap,
+			HTTPMaxIdleConns:          maxIdleConns,
+			HTTPIdleConnTimeout:       idleConnTimeout.String(),
+			HTTPTLSHandshakeTimeout:   tlsHandshakeTimeout.String(),
+			TLSMinVersion:             tlsMinVersion,
+			TLSInsecureSkipVerify:     tlsInsecure,
+			BreakerThreshold:          breakerThreshold,
+			BreakerCooldown:           breakerCooldown.String(),
+			Locale:                    localeName,
+			Lenient:                   parseOpts.lenient,
+			CollectExtra:              parseOpts.collectExtra,
+			StoreRawHtml:              parseOpts.keepRawHtml,
+			MergeDuplicateAttachments: parseOpts.mergeDuplicateAttachments,
+			MaxTitleLength:            parseOpts.maxTitleLen,
+			MaxCategoryLength:         parseOpts.maxCategoryLen,
+			SchoolYearStartMonth:      int(parseOpts.schoolYearStartMonth),
+			MaxAttachmentTitleLength:  parseOpts.maxAttachmentTitleLen,
+			MinDate:                   os.Getenv("CIRCULARS_MIN_DATE"),
+			MinId:                     minId,
+			IdReuseThreshold:          idReuse.threshold,
+			IdReuseKeepStored:         idReuse.keepStored,
+			MaxDate:                   os.Getenv("CIRCULARS_MAX_DATE"),
+			NormalizeWhitespace:       lookupEnvBool("CIRCULARS_NORMALIZE_WHITESPACE", false),
+			Categories:                os.Getenv("CIRCULARS_CATEGORIES"),
+			CategoryMap:               os.Getenv("CIRCULARS_CATEGORY_MAP"),
+			CategoryTitleCase:         categoryTitleCase,
+			InsertStrategy:            strategy,
+			WebhookUrl:                redactUrl(webhookUrl),
+			NotifyRoutesFile:          os.Getenv("CIRCULARS_NOTIFY_ROUTES_FILE"),
+			WebhookSecret:             redactSecret(webhookOpts.secret),
+			WebhookRetries:            webhookOpts.retries,
+			CleanupScope:              scopeName,
+			CleanupResync:             resyncOnCleanup,
+			CleanupOnInsertFailure:    cleanupOnInsertFailure,
+			CleanupOnStart:            cleanupOnStart,
+			StoreRejected:             storeRejected,
+			DeleteGrace:               deleteGrace.String(),
+			MaxDeletePercent:          maxDeletePercent,
+			DisableDelete:             disableDelete,
+			Migrate:                   migrate,
+			MaxConsecutiveFailures:    maxConsecutiveFailures,
+			ShutdownTimeout:           shutdownTimeout.String(),
+			Fulltext:                  fulltext,
+			HTTPAddr:                  httpAddr,
+			HTTPToken:                 redactSecret(httpToken),
+			AdminToken:                redactSecret(adminToken),
+			RefreshShared:             refreshShared,
+			StatsTTL:                  statsTTL.String(),
+			CacheSize:                 cacheSize,
+			ProxyAttachments:          proxyAttachments,
+			ValidUntil:                validUntil,
+			LogFile:                   os.Getenv("CIRCULARS_LOG_FILE"),
+		}
+		if attachmentsDownloader != nil {
+			cfg.DownloadDir, cfg.DownloadPath = attachmentsDownloader.dir, attachmentsDownloader.pathTemplate
+			cfg.DownloadMaxPerCircular = attachmentsDownloader.maxPerCircular
+			cfg.DownloadConcurrency = cap(attachmentsDownloader.sem)
+		}
+		if prober != nil {
+			cfg.ProbeAttachments, cfg.ProbeConcurrency = true, cap(prober.sem)
+		}
+		if queue != nil {
+			cfg.QueueDir, cfg.QueueMaxBatches = queue.dir, queue.maxBatches
+		}
+		if duplicates != nil {
+			cfg.DuplicateThreshold, cfg.DuplicateWindow = duplicates.threshold, duplicates.window.String()
+		}
+		if err := cfg.print(os.Stdout); err != nil {
+			log.Fatalf("ERROR: %v", err)
+		}
+		return
+	}
+
+	// Connections are pooled and shared between cycles and HTTP endpoints
+	db, err := sql.Open(dbDriver, connectionString)
+	if err != nil {
+		log.Fatalf("ERROR: %v", err)
+	}
+	defer db.Close()
+	// Idle connections are closed before MySQL's wait_timeout, or a proxy, kills them, so a cycle doesn't get an invalid connection
+	db.SetConnMaxIdleTime(dbMaxIdleTime)
+
+	// The DB could still be starting, e.g. with docker-compose
+	if err := waitForDB(db, dbStartupTimeout); err != nil {
+		log.Fatalf("ERROR: %v", err)
+	}
+	if migrate {
+		if err := migrateDB(db, dbDriver, columns); err != nil {
+			log.Fatalf("ERROR: can't migrate the schema: %v", err)
+		}
+	}
+	if err := checkColumns(db, columns, deleteGrace > 0); err != nil {
+		log.Fatalf("ERROR: the tables don't match the column mapping, set CIRCULARS_COLUMN_MAP: %v", err)
+	}
+	checkUniqueKeys(db)
+	if dbPingInterval > 0 {
+		go pingDB(ctx, db, dbPingInterval)
+	}
+	readDB := db
+	if readConnectionString != "" {
+		readDB, err = sql.Open(dbDriver, readConnectionString)
 		if err != nil {
-			log.Printf("ERROR: %v", err)
-			continue
+			log.Fatalf("ERROR: %v", err)
+		}
+		defer readDB.Close()
+		readDB.SetConnMaxIdleTime(dbMaxIdleTime)
+		if err := waitForDB(readDB, dbStartupTimeout); err != nil {
+			log.Fatalf("ERROR: read replica: %v", err)
+		}
+		if dbPingInterval > 0 {
+			go pingDB(ctx, readDB, dbPingInterval)
+		}
+		log.Printf("INFO: the HTTP endpoints read from the replica")
+	}
+	checkColumnLengths(db, parseOpts)
+
+	if *reprocessDir != "" {
+		if err := reprocess(db, *reprocessDir, siteUrls, parseOpts, transformers, *reprocessWrite); err != nil {
+			log.Fatalf("ERROR: reprocess failed: %v", err)
 		}
-		log.Printf("INFO: updated DB")
+		return
+	}
 
-		// Remove deleted circulars with a lower frequency
-		if nextTime.After(nextCleanupTime) {
-			nextCleanupTime = nextTime.Truncate(time.Hour).Add(6 * time.Hour)
+	// Get whether searches use a FULLTEXT index, created when missing
+	fulltextMinToken := 0
+	if fulltext {
+		fulltextMinToken, err = ensureFulltextIndex(db)
+		if err != nil {
+			log.Fatalf("ERROR: can't create the FULLTEXT index: %v", err)
+		}
+	}
 
-			log.Printf("INFO: removing deleted circulars")
-			removedCirculars, removedAttachments, err := deleteRemovedCirculars(circulars, connectionString)
-			if err != nil {
-				log.Printf("ERROR: %v", err)
-				continue
+	breakers := newBreakerSet(siteUrls, breakerThreshold, breakerCooldown)
+	metricBreakerState.Set(func() interface{} { return breakers.states() })
+
+	w := &worker{
+		client:                 client,
+		db:                     db,
+		readDB:                 readDB,
+		siteUrls:               siteUrls,
+		concurrency:            concurrency,
+		cycleTimeout:           cycleTimeout,
+		breakers:               breakers,
+		notifier:               notifier,
+		downloader:             attachmentsDownloader,
+		prober:                 prober,
+		duplicates:             duplicates,
+		queue:                  queue,
+		shouldUpdate:           shouldUpdate,
+		cleanupScope:           scope,
+		deleteGrace:            deleteGrace,
+		maxDeletePercent:       maxDeletePercent,
+		cleanupOnly:            *cleanupOnly,
+		resyncOnCleanup:        resyncOnCleanup,
+		cleanupOnInsertFailure: cleanupOnInsertFailure,
+		storeRejected:          storeRejected,
+		fetchOpts:              fetchOpts,
+		parseOpts:              parseOpts,
+		transformers:           transformers,
+		fulltextMinToken:       fulltextMinToken,
+		stats:                  &statsCache{ttl: statsTTL},
+		cache:                  newCircularsCache(cacheSize),
+		proxyAttachments:       proxyAttachments,
+		adminEndpoints:         adminToken != "",
+		validUntilInclusive:    validUntil == "inclusive",
+	}
+	if refreshShared {
+		w.refresh = &refreshFlight{}
+	}
+
+	if *cleanupOnly {
+		if disableDelete {
+			log.Fatal("ERROR: -cleanup-only can't run with CIRCULARS_DISABLE_DELETE")
+		}
+		res, err := w.runCycle(true)
+		if err != nil {
+			log.Fatalf("ERROR: cleanup failed: %v", err)
+		}
+		fmt.Printf("removed %d circulars and %d attachments\n", res.RemovedCirculars, res.RemovedAttachments)
+		return
+	}
+
+	// Start the HTTP server
+	if httpEnabled {
+		go serveHTTP(httpAddr, httpToken, adminToken, w)
+	}
+
+	// First time execute without waiting, unless the first cycle waits for its turn
+	nextTime := time.Now().UTC()
+	// The first cleanup waits for cleanupInterval, unless it's forced
+	nextCleanupTime := nextTime.Add(cleanupInterval)
+	if cleanupOnStart {
+		nextCleanupTime = nextTime
+	} else if !disableDelete {
+		log.Printf("INFO: first cleanup not before %s", nextCleanupTime.Format(time.RFC3339))
+	}
+	if lookupEnvBool("CIRCULARS_SKIP_INITIAL_RUN", false) {
+		if schedule != nil {
+			nextTime = schedule.next(time.Now())
+		} else {
+			nextTime = nextTime.Add(parseTimeout)
+		}
+		log.Printf("INFO: first cycle at %s", nextTime.Format(time.RFC3339))
+	}
+	// The running cycle can complete after a signal, but only for shutdownTimeout
+	go func() {
+		<-ctx.Done()
+		if shutdownTimeout <= 0 {
+			return
+		}
+		time.Sleep(shutdownTimeout)
+		log.Printf("ERROR: the running cycle didn't complete within %v of the shutdown, forcing exit", shutdownTimeout)
+		os.Exit(1)
+	}()
+	consecutiveFailures := 0
+	for {
+		// Wait for next round
+		select {
+		case <-ctx.Done():
+			log.Println("INFO: shutting down")
+			return
+		case <-time.After(time.Until(nextTime)):
+		}
+		// Both can be ready when a cycle ran past its next time, the signal wins
+		if ctx.Err() != nil {
+			log.Println("INFO: shutting down")
+			return
+		}
+		if schedule != nil {
+			// Cron expressions refer to the local time, set with the TZ env variable
+			nextTime = schedule.next(time.Now())
+		} else {
+			nextTime = nextTime.Truncate(time.Minute).Add(parseTimeout)
+		}
+
+		// Remove deleted circulars with a lower frequency. A panic fails the cycle, not the process
+		res, err := func() (res cycleResult, err error) {
+			defer recoverPanic("cycle", &err)
+			return w.runCycle(!disableDelete && nextTime.After(nextCleanupTime))
+		}()
+		if res.cleanupAttempted {
+			nextCleanupTime = nextTime.Truncate(time.Hour).Add(cleanupInterval)
+		}
+		if err != nil {
+			log.Printf("ERROR: %v", err)
+			// Exiting lets the orchestrator restart the process or alert
+			consecutiveFailures++
+			if maxConsecutiveFailures > 0 && consecutiveFailures >= maxConsecutiveFailures {
+				log.Fatalf("ERROR: %d consecutive cycles failed, exiting", consecutiveFailures)
 			}
-			log.Printf("INFO: removed %d circulars and %d attachments", removedCirculars, removedAttachments)
+			continue
 		}
+		consecutiveFailures = 0
 
 		log.Println("INFO: waiting")
 	}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// parseFixture returns the circulars parsed from selftestFixture with the default options
+func parseFixture(t *testing.T) ([]circular, []parseError) {
+	t.Helper()
+	circulars, parseErrors, err := parseCirculars(strings.NewReader(selftestFixture), parseOptions{locale: locales[defaultLocale], mergeDuplicateAttachments: true, schoolYearStartMonth: defaultSchoolYearStartMonth})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return circulars, parseErrors
+}
+
+// type expectedCircular are the parsed fields of a circular of selftestFixture
+type expectedCircular struct {
+	id         uint64
+	title      string
+	pinned     bool
+	protocol   string
+	recipients []string
+	modified   string
+	// attachments are the ids of the attachments, in order, with their sizes
+	attachments []uint64
+	sizes       []uint64
+}
+
+func TestParseCirculars(t *testing.T) {
+	expected := []expectedCircular{
+		// The title follows an empty icon span
+		{id: 1005, title: "Circolare n. 5 - Sciopero del personale"},
+		// The row has an extra leading cell
+		{id: 1004, title: "Circolare n. 4 - Assemblea di classe", attachments: []uint64{2007}, sizes: []uint64{0}},
+		// Sizes in the link and after it
+		{id: 1003, title: "Circolare n. 3 - Uscita didattica", pinned: true, protocol: "987/C2", recipients: []string{"genitori", "studenti"},
+			attachments: []uint64{2004, 2005}, sizes: []uint64{1258291, 358400}},
+		// The protocol is in the title, the repeated attachment 2003 is merged keeping its size
+		{id: 1002, title: "Circolare n. 2 - Orario provvisorio (Prot. n. 1234/2023)", protocol: "1234/2023", modified: "2023-09-14",
+			attachments: []uint64{2003, 2006}, sizes: []uint64{81920, 0}},
+		{id: 1001, title: "Circolare n. 1 - Inizio lezioni"},
+	}
+
+	circulars, parseErrors := parseFixture(t)
+	if len(circulars) != len(expected) {
+		t.Fatalf("parsed %d circulars, expected %d", len(circulars), len(expected))
+	}
+	for i, e := range expected {
+		c := circulars[i]
+		if c.Id != e.id || c.Title != e.title {
+			t.Errorf("circular %d: got %d %q, expected %d %q", i, c.Id, c.Title, e.id, e.title)
+			continue
+		}
+		if c.Pinned != e.pinned {
+			t.Errorf("circular %d: pinned %t, expected %t", c.Id, c.Pinned, e.pinned)
+		}
+		if c.Protocol != e.protocol {
+			t.Errorf("circular %d: protocol %q, expected %q", c.Id, c.Protocol, e.protocol)
+		}
+		if len(c.Recipients) > 0 || len(e.recipients) > 0 {
+			if !reflect.DeepEqual(c.Recipients, e.recipients) {
+				t.Errorf("circular %d: recipients %v, expected %v", c.Id, c.Recipients, e.recipients)
+			}
+		}
+		var modified string
+		if c.ModifiedDate != nil {
+			modified = c.ModifiedDate.Format("2006-01-02")
+		}
+		if modified != e.modified {
+			t.Errorf("circular %d: modified date %q, expected %q", c.Id, modified, e.modified)
+		}
+		// Every circular of the fixture is published from 01/09/2023
+		if c.SchoolYear != "2023/2024" {
+			t.Errorf("circular %d: school year %q, expected 2023/2024", c.Id, c.SchoolYear)
+		}
+		var ids, sizes []uint64
+		for _, att := range c.Attachments {
+			ids, sizes = append(ids, att.Id), append(sizes, att.SizeBytes)
+		}
+		if !reflect.DeepEqual(ids, e.attachments) || !reflect.DeepEqual(sizes, e.sizes) {
+			t.Errorf("circular %d: attachments %v with sizes %v, expected %v with %v", c.Id, ids, sizes, e.attachments, e.sizes)
+		}
+	}
+
+	if len(parseErrors) != 1 || parseErrors[0].Id != 1000 || parseErrors[0].Field != "category" {
+		t.Errorf("got parse errors %v, expected only the missing category of circular 1000", parseErrors)
+	}
+}
+
+func TestSchoolYear(t *testing.T) {
+	tests := []struct {
+		date     time.Time
+		expected string
+	}{
+		{time.Date(2023, time.August, 31, 0, 0, 0, 0, time.UTC), "2022/2023"},
+		{time.Date(2023, time.September, 1, 0, 0, 0, 0, time.UTC), "2023/2024"},
+		{time.Date(2024, time.January, 15, 0, 0, 0, 0, time.UTC), "2023/2024"},
+		{time.Time{}, ""},
+	}
+	for _, tt := range tests {
+		if got := schoolYear(tt.date, defaultSchoolYearStartMonth); got != tt.expected {
+			t.Errorf("school year of %s is %q, expected %q", tt.date.Format("2006-01-02"), got, tt.expected)
+		}
+	}
+}
+
+func TestCountRowsTableWrap(t *testing.T) {
+	// The bare rows of the fixture are wrapped, the whole fixture already has its table
+	bare := selftestFixture[strings.Index(selftestFixture, "<table>")+len("<table>") : strings.Index(selftestFixture, "</table>")]
+	for name, page := range map[string]string{"bare": bare, "wrapped": selftestFixture} {
+		rows, err := countRows(page, tableWrapAuto)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rows != 6 {
+			t.Errorf("%s: counted %d rows, expected 6", name, rows)
+		}
+	}
+}
+
+func TestIdsToRemove(t *testing.T) {
+	tests := []struct {
+		name      string
+		dbIds     []uint64
+		parsedIds []uint64
+		expected  []uint64
+	}{
+		{"smaller than all parsed", []uint64{1, 10}, []uint64{10, 20, 30}, []uint64{1}},
+		{"larger than all parsed", []uint64{40, 20}, []uint64{10, 20, 30}, []uint64{40}},
+		{"on the boundaries", []uint64{30, 10}, []uint64{20, 10, 30}, nil},
+		{"between the boundaries", []uint64{15, 25}, []uint64{10, 20, 30}, []uint64{15, 25}},
+		{"nothing parsed", []uint64{3, 2, 1}, []uint64{}, []uint64{3, 2, 1}},
+		{"nil parsed", []uint64{1}, nil, []uint64{1}},
+		{"nothing stored", nil, []uint64{1, 2}, nil},
+		{"duplicate parsed", []uint64{5, 4, 3}, []uint64{5, 3, 5, 3}, []uint64{4}},
+		{"duplicate stored", []uint64{7, 7, 6}, []uint64{6}, []uint64{7, 7}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := idsToRemove(tt.dbIds, tt.parsedIds); !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("idsToRemove(%v, %v) = %v, expected %v", tt.dbIds, tt.parsedIds, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestCleanupScopeWhere(t *testing.T) {
+	minDate := time.Date(2023, time.September, 1, 0, 0, 0, 0, time.UTC)
+	maxDate := time.Date(2024, time.August, 31, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		scope    cleanupScope
+		cond     string
+		expected []interface{}
+	}{
+		{"all", cleanupScope{}, "", nil},
+		{"fetched", cleanupScope{fetchedOnly: true}, " WHERE c.`id` >= ?", []interface{}{uint64(10)}},
+		{"min id", cleanupScope{minId: 5}, " WHERE c.`id` >= ?", []interface{}{uint64(5)}},
+		{"min date", cleanupScope{minDate: minDate}, " WHERE (c.`data` IS NULL OR c.`data` >= ?)", []interface{}{"2023-09-01"}},
+		{"date range", cleanupScope{minDate: minDate, maxDate: maxDate},
+			" WHERE (c.`data` IS NULL OR c.`data` >= ?) AND (c.`data` IS NULL OR c.`data` <= ?)", []interface{}{"2023-09-01", "2024-08-31"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cond, args := tt.scope.where([]uint64{30, 10, 20})
+			if cond != tt.cond || !reflect.DeepEqual(args, tt.expected) {
+				t.Errorf("got %q %v, expected %q %v", cond, args, tt.cond, tt.expected)
+			}
+		})
+	}
+}
+
+func TestDocumentUrl(t *testing.T) {
+	tests := []struct {
+		name, siteUrl, action string
+		id                    uint64
+		expected              string
+	}{
+		{"site url", "https://web.spaggiari.eu/sdg/app/default/comunicati.php?sede_codice=XXXX0000", "akVIEW_FROM_ID", 1234,
+			"https://web.spaggiari.eu/sdg/app/default/view_documento.php?a=akVIEW_FROM_ID&id_documento=1234&sede_codice=XXXX0000"},
+		{"trailing slash", "https://web.spaggiari.eu/sdg/app/default/?sede_codice=XXXX0000", "akDOWNLOAD", 5,
+			"https://web.spaggiari.eu/sdg/app/default/view_documento.php?a=akDOWNLOAD&id_documento=5&sede_codice=XXXX0000"},
+		// Only sede_codice is kept
+		{"other query parameters", "https://web.spaggiari.eu/sdg/app/default/comunicati.php?anno=2023&sede_codice=XXXX0000&pagina=2", "akDOWNLOAD", 5,
+			"https://web.spaggiari.eu/sdg/app/default/view_documento.php?a=akDOWNLOAD&id_documento=5&sede_codice=XXXX0000"},
+		{"escaping", "https://web.spaggiari.eu/sdg/app/default/comunicati.php?sede_codice=XX%26Y%20Z", "ak VIEW&x=1", 18446744073709551615,
+			"https://web.spaggiari.eu/sdg/app/default/view_documento.php?a=ak+VIEW%26x%3D1&id_documento=18446744073709551615&sede_codice=XX%26Y+Z"},
+		{"without query parameters", "https://web.spaggiari.eu/sdg/app/default/comunicati.php", "akDOWNLOAD", 5, ""},
+		{"empty sede_codice", "https://web.spaggiari.eu/sdg/app/default/comunicati.php?sede_codice=", "akDOWNLOAD", 5, ""},
+		{"invalid site url", "://web.spaggiari.eu", "akDOWNLOAD", 5, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := documentUrl(tt.siteUrl, tt.action, tt.id)
+			if tt.expected == "" {
+				if err == nil {
+					t.Errorf("got %s, expected an error", got)
+				}
+				return
+			}
+			if err != nil || got != tt.expected {
+				t.Errorf("got %s, %v, expected %s", got, err, tt.expected)
+			}
+		})
+	}
+
+	// The detail page is the view action
+	got, err := circularUrl("https://web.spaggiari.eu/sdg/app/default/comunicati.php?sede_codice=XXXX0000", 1234)
+	if expected := "https://web.spaggiari.eu/sdg/app/default/view_documento.php?a=akVIEW_FROM_ID&id_documento=1234&sede_codice=XXXX0000"; err != nil || got != expected {
+		t.Errorf("circularUrl: got %s, %v, expected %s", got, err, expected)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		s    string
+		size uint64
+		rest string
+	}{
+		{"Orario.pdf (512 bytes)", 512, "Orario.pdf"},
+		{"Orario.pdf (1 byte)", 1, "Orario.pdf"},
+		{"Orario.pdf (10 B)", 10, "Orario.pdf"},
+		{"Orario.pdf (350 KB)", 358400, "Orario.pdf"},
+		{"Orario.pdf (1.5 kb)", 1536, "Orario.pdf"},
+		{"Orario.pdf (3 MiB)", 3145728, "Orario.pdf"},
+		{"Programma.pdf (1,2 MB)", 1258291, "Programma.pdf"},
+		{"Programma.pdf (1.2 MB)", 1258291, "Programma.pdf"},
+		{"Video.mp4 ( 2 GB )", 2147483648, "Video.mp4"},
+		{"(350 KB)", 358400, ""},
+		{"Prima (1 MB) dopo", 1048576, "Prima  dopo"},
+		// Nothing to parse, s is returned as it is
+		{"Orario.pdf (350)", 0, "Orario.pdf (350)"},
+		{"Orario.pdf 350 KB", 0, "Orario.pdf 350 KB"},
+		{"Classe 2 B", 0, "Classe 2 B"},
+		{"Orario.pdf (abc KB)", 0, "Orario.pdf (abc KB)"},
+		{"Orario.pdf (1,2,3 MB)", 0, "Orario.pdf (1,2,3 MB)"},
+		{"Orario.pdf (2 TB)", 0, "Orario.pdf (2 TB)"},
+		{"", 0, ""},
+	}
+	for _, tt := range tests {
+		if size, rest := parseSize(tt.s); size != tt.size || rest != tt.rest {
+			t.Errorf("parseSize(%q) = %d, %q, expected %d, %q", tt.s, size, rest, tt.size, tt.rest)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// type columnMapping contains the actual names of the columns of the circolare and circolare_allegato tables,
+// so the circulars can be stored in an existing schema with its own names
+type columnMapping struct {
+	// circolare
+	id, title, category, publishedDate, publishedDateRaw, validUntilDate string
+	url, extra, pinned, protocol, addedAt, updatedAt, missingSince       string
+	contentHash, recipients, schoolYear, modifiedDate, deletedAt         string
+	// circolare_allegato
+	attachmentId, attachmentTitle, attachmentCircularId, attachmentSortOrder, attachmentSize string
+	attachmentMimeType                                                                       string
+}
+
+// columns is the mapping used by every query, replaced at startup by CIRCULARS_COLUMN_MAP
+var columns = defaultColumns()
+
+// defaultColumns returns the mapping of the default schema
+func defaultColumns() columnMapping {
+	return columnMapping{
+		id:                   "id",
+		title:                "titolo",
+		category:             "categoria",
+		publishedDate:        "data",
+		publishedDateRaw:     "data_raw",
+		validUntilDate:       "valida_fino",
+		url:                  "url",
+		extra:                "extra",
+		pinned:               "in_evidenza",
+		protocol:             "protocollo",
+		addedAt:              "aggiunta_il",
+		updatedAt:            "aggiornata_il",
+		missingSince:         "missing_since",
+		contentHash:          "content_hash",
+		recipients:           "destinatari",
+		schoolYear:           "anno_scolastico",
+		modifiedDate:         "data_modifica",
+		deletedAt:            "deleted_at",
+		attachmentId:         "id_allegato",
+		attachmentTitle:      "titolo",
+		attachmentCircularId: "id_circolare",
+		attachmentSortOrder:  "sort_order",
+		attachmentSize:       "dimensione",
+		attachmentMimeType:   "mime_type",
+	}
+}
+
+// type mappedColumn is a column of the mapping, with the logical name used by CIRCULARS_COLUMN_MAP
+type mappedColumn struct {
+	logical, table string
+	name           *string
+}
+
+// list returns every column of the mapping
+func (m *columnMapping) list() []mappedColumn {
+	return []mappedColumn{
+		{"id", "circolare", &m.id},
+		{"title", "circolare", &m.title},
+		{"category", "circolare", &m.category},
+		{"published_date", "circolare", &m.publishedDate},
+		{"published_date_raw", "circolare", &m.publishedDateRaw},
+		{"valid_until", "circolare", &m.validUntilDate},
+		{"url", "circolare", &m.url},
+		{"extra", "circolare", &m.extra},
+		{"pinned", "circolare", &m.pinned},
+		{"protocol", "circolare", &m.protocol},
+		{"added_at", "circolare", &m.addedAt},
+		{"updated_at", "circolare", &m.updatedAt},
+		{"missing_since", "circolare", &m.missingSince},
+		{"content_hash", "circolare", &m.contentHash},
+		{"recipients", "circolare", &m.recipients},
+		{"school_year", "circolare", &m.schoolYear},
+		{"modified_date", "circolare", &m.modifiedDate},
+		{"deleted_at", "circolare", &m.deletedAt},
+		{"attachment_id", "circolare_allegato", &m.attachmentId},
+		{"attachment_title", "circolare_allegato", &m.attachmentTitle},
+		{"attachment_circular_id", "circolare_allegato", &m.attachmentCircularId},
+		{"attachment_sort_order", "circolare_allegato", &m.attachmentSortOrder},
+		{"attachment_size", "circolare_allegato", &m.attachmentSize},
+		{"attachment_mime_type", "circolare_allegato", &m.attachmentMimeType},
+	}
+}
+
+// columnNamePattern limits the column names to the ones that don't need escaping
+var columnNamePattern = regexp.MustCompile(`^[A-Za-z0-9_$]{1,64}$`)
+
+// parseColumnMapping returns the default mapping with the columns overridden by s,
+// a comma separated list of logical=column, e.g. "title=oggetto,published_date=pubblicazione"
+func parseColumnMapping(s string) (columnMapping, error) {
+	m := defaultColumns()
+	byLogical := make(map[string]*string)
+	for _, c := range m.list() {
+		byLogical[c.logical] = c.name
+	}
+
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return m, fmt.Errorf("%q isn't logical=column", pair)
+		}
+		logical, name := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		column, exists := byLogical[logical]
+		if !exists {
+			return m, fmt.Errorf("unknown field %q", logical)
+		}
+		if !columnNamePattern.MatchString(name) {
+			return m, fmt.Errorf("invalid column name %q", name)
+		}
+		*column = name
+	}
+	return m, nil
+}
+
+// checkColumns returns an error listing the mapped columns missing from the DB.
+// missing_since is only required with a grace period
+func checkColumns(db *sql.DB, m columnMapping, needMissingSince bool) error {
+	var missing []string
+	for _, c := range m.list() {
+		if c.logical == "missing_since" && !needMissingSince {
+			continue
+		}
+		exists, err := columnExists(db, c.table, *c.name)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			missing = append(missing, fmt.Sprintf("%s.%s (%s)", c.table, *c.name, c.logical))
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing columns: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// quoteColumns returns the comma separated list of the quoted column names
+func quoteColumns(names ...string) string {
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = "`" + name + "`"
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// unchangedColumns returns the condition, inside ON DUPLICATE KEY UPDATE, that every column keeps its value
+func unchangedColumns(names ...string) string {
+	conds := make([]string, len(names))
+	for i, name := range names {
+		conds[i] = "`" + name + "` <=> VALUES(`" + name + "`)"
+	}
+	return strings.Join(conds, " AND ")
+}
+
+// updateColumns returns the ON DUPLICATE KEY UPDATE assignments setting each column to the inserted value
+func updateColumns(names ...string) string {
+	assignments := make([]string, len(names))
+	for i, name := range names {
+		assignments[i] = "`" + name + "` = VALUES(`" + name + "`)"
+	}
+	return strings.Join(assignments, ", ")
+}
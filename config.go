@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/go-sql-driver/mysql"
+	"io"
+	"net/url"
+)
+
+// redacted replaces the secrets in the printed configuration
+const redacted = "REDACTED"
+
+// type effectiveConfig is the resolved configuration printed by -print-config, secrets are redacted.
+// Durations are strings as accepted by time.ParseDuration, empty strings mean not set
+type effectiveConfig struct {
+	Profile                   string   `json:"profile,omitempty"`
+	DBConnectionString        string   `json:"db_connection_string"`
+	DBReadConnectionString    string   `json:"db_read_connection_string,omitempty"`
+	DBStartupTimeout          string   `json:"db_startup_timeout"`
+	DBMaxIdleTime             string   `json:"db_max_idle_time"`
+	DBPingInterval            string   `json:"db_ping_interval"`
+	ColumnMap                 string   `json:"column_map"`
+	SiteUrls                  []string `json:"site_urls"`
+	Concurrency               int      `json:"concurrency"`
+	Cron                      string   `json:"cron"`
+	CycleWait                 string   `json:"cycle_wait"`
+	CycleTimeout              string   `json:"cycle_timeout"`
+	FetchMode                 string   `json:"fetch_mode"`
+	DebugCaptureDir           string   `json:"debug_capture_dir"`
+	SearchAction              string   `json:"search_action"`
+	SearchField               string   `json:"search_field"`
+	MaxResponseBytes          int64    `json:"max_response_bytes"`
+	ErrorSnippetBytes         int      `json:"error_snippet_bytes"`
+	TableWrap                 string   `json:"table_wrap"`
+	HTTPMaxIdleConns          int      `json:"http_max_idle_conns"`
+	HTTPIdleConnTimeout       string   `json:"http_idle_conn_timeout"`
+	HTTPTLSHandshakeTimeout   string   `json:"http_tls_handshake_timeout"`
+	TLSMinVersion             string   `json:"tls_min_version"`
+	TLSInsecureSkipVerify     bool     `json:"tls_insecure_skip_verify"`
+	BreakerThreshold          int      `json:"breaker_threshold"`
+	BreakerCooldown           string   `json:"breaker_cooldown"`
+	Locale                    string   `json:"locale"`
+	Lenient                   bool     `json:"lenient"`
+	CollectExtra              bool     `json:"collect_extra"`
+	StoreRawHtml              bool     `json:"store_raw_html"`
+	MergeDuplicateAttachments bool     `json:"merge_duplicate_attachments"`
+	MaxTitleLength            int      `json:"max_title_length"`
+	MaxCategoryLength         int      `json:"max_category_length"`
+	SchoolYearStartMonth      int      `json:"school_year_start_month"`
+	MaxAttachmentTitleLength  int      `json:"max_attachment_title_length"`
+	MinDate                   string   `json:"min_date"`
+	MinId                     uint64   `json:"min_id"`
+	IdReuseThreshold          float64  `json:"id_reuse_threshold"`
+	IdReuseKeepStored         bool     `json:"id_reuse_keep_stored"`
+	DuplicateThreshold        float64  `json:"duplicate_threshold"`
+	DuplicateWindow           string   `json:"duplicate_window"`
+	MaxDate                   string   `json:"max_date"`
+	NormalizeWhitespace       bool     `json:"normalize_whitespace"`
+	Categories                string   `json:"categories"`
+	CategoryMap               string   `json:"category_map"`
+	CategoryTitleCase         bool     `json:"category_title_case"`
+	InsertStrategy            string   `json:"insert_strategy"`
+	WebhookUrl                string   `json:"webhook_url"`
+	NotifyRoutesFile          string   `json:"notify_routes_file"`
+	WebhookSecret             string   `json:"webhook_secret"`
+	WebhookRetries            int      `json:"webhook_retries"`
+	DownloadDir               string   `json:"download_dir"`
+	DownloadPath              string   `json:"download_path"`
+	DownloadMaxPerCircular    int      `json:"download_max_per_circular"`
+	DownloadConcurrency       int      `json:"download_concurrency"`
+	ProbeAttachments          bool     `json:"probe_attachments"`
+	ProbeConcurrency          int      `json:"probe_concurrency,omitempty"`
+	QueueDir                  string   `json:"queue_dir,omitempty"`
+	QueueMaxBatches           int      `json:"queue_max_batches,omitempty"`
+	CleanupScope              string   `json:"cleanup_scope"`
+	CleanupResync             bool     `json:"cleanup_resync"`
+	CleanupOnInsertFailure    bool     `json:"cleanup_on_insert_failure"`
+	CleanupOnStart            bool     `json:"cleanup_on_start"`
+	StoreRejected             bool     `json:"store_rejected"`
+	DeleteGrace               string   `json:"delete_grace"`
+	MaxDeletePercent          int      `json:"max_delete_percent"`
+	DisableDelete             bool     `json:"disable_delete"`
+	Migrate                   bool     `json:"migrate"`
+	MaxConsecutiveFailures    int      `json:"max_consecutive_failures"`
+	ShutdownTimeout           string   `json:"shutdown_timeout"`
+	Fulltext                  bool     `json:"fulltext"`
+	HTTPAddr                  string   `json:"http_addr"`
+	HTTPToken                 string   `json:"http_token"`
+	AdminToken                string   `json:"admin_token"`
+	RefreshShared             bool     `json:"refresh_shared"`
+	StatsTTL                  string   `json:"stats_ttl"`
+	CacheSize                 int      `json:"cache_size"`
+	ProxyAttachments          bool     `json:"proxy_attachments"`
+	ValidUntil                string   `json:"valid_until"`
+	LogFile                   string   `json:"log_file"`
+}
+
+// print writes the configuration as indented JSON
+func (c effectiveConfig) print(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(c)
+}
+
+// redactSecret hides s, keeping whether it's set
+func redactSecret(s string) string {
+	if s == "" {
+		return ""
+	}
+	return redacted
+}
+
+// redactDSN hides the password of the DB connection string.
+// When it can't be parsed the whole string is hidden, as the password could be anywhere
+func redactDSN(dsn string) string {
+	if dsn == "" {
+		return ""
+	}
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return redacted
+	}
+	if cfg.Passwd != "" {
+		cfg.Passwd = redacted
+	}
+	return cfg.FormatDSN()
+}
+
+// redactUrl hides the credentials of u, as webhooks often carry a token in the user info, the path or the query values.
+// Only the scheme and the host are kept, when it can't be parsed the whole url is hidden
+func redactUrl(u string) string {
+	if u == "" {
+		return ""
+	}
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return redacted
+	}
+	if parsed.Scheme == "" || parsed.Host == "" {
+		return redacted
+	}
+	kept := parsed.Scheme + "://" + parsed.Hostname()
+	if port := parsed.Port(); port != "" {
+		kept += ":" + port
+	}
+	if parsed.User != nil || (parsed.Path != "" && parsed.Path != "/") || parsed.RawQuery != "" {
+		kept += "/" + redacted
+	}
+	return kept
+}
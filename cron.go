@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// type cronSchedule is a parsed standard cron expression with 5 fields: minute hour day-of-month month day-of-week.
+// Every field supports '*', single values, ranges 'a-b', steps '*/n' or 'a-b/n' and comma separated lists of them.
+// Each field is stored as a bitset of the matching values
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// domStar and dowStar are true when the field starts with '*', e.g. '*' or '*/2'. As in cron they change how days are matched
+	domStar, dowStar bool
+}
+
+// parseCron parses a standard 5 fields cron expression, e.g. "*/15 7-18 * * 1-5"
+func parseCron(expr string) (*cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, errors.New("cron expression must have 5 fields")
+	}
+
+	var s cronSchedule
+	var err error
+	if s.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if s.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if s.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if s.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, err
+	}
+	// Both 0 and 7 are sunday
+	if s.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, err
+	}
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	s.domStar = strings.HasPrefix(fields[2], "*")
+	s.dowStar = strings.HasPrefix(fields[4], "*")
+
+	return &s, nil
+}
+
+// parseCronField parses a single cron field into a bitset of the values between min and max it matches
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			rangePart, step = part[:i], n
+		}
+
+		lo, hi := min, max
+		if rangePart != "*" {
+			var err error
+			if i := strings.Index(rangePart, "-"); i >= 0 {
+				lo, err = strconv.Atoi(rangePart[:i])
+				if err == nil {
+					hi, err = strconv.Atoi(rangePart[i+1:])
+				}
+			} else {
+				lo, err = strconv.Atoi(rangePart)
+				// 'a/n' means from a to the end of the range
+				if step == 1 {
+					hi = lo
+				}
+			}
+			if err != nil {
+				return 0, fmt.Errorf("invalid value in %q", part)
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("value out of range [%d-%d] in %q", min, max, part)
+		}
+
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// dayMatches reports whether the day of t is matched.
+// As in cron, when both day-of-month and day-of-week are restricted, matching either one is enough
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+	domMatch := s.dom&(1<<uint(t.Day())) != 0
+	dowMatch := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+// next returns the first time after t matched by the schedule, in the location of t.
+// Returns the zero time if nothing matches in the next 5 years (e.g. "0 0 30 2 *")
+func (s *cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronScheduleNext(t *testing.T) {
+	at := func(s string) time.Time {
+		t, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			panic(err)
+		}
+		return t
+	}
+	// 2024-01-01 is a monday
+	tests := []struct {
+		name, expr, from, expected string
+	}{
+		{"step", "*/15 * * * *", "2024-01-01 10:07", "2024-01-01 10:15"},
+		{"strictly after", "*/15 * * * *", "2024-01-01 10:15", "2024-01-01 10:30"},
+		{"range step", "5-20/5 * * * *", "2024-01-01 10:20", "2024-01-01 11:05"},
+		{"start step", "10/20 * * * *", "2024-01-01 10:31", "2024-01-01 10:50"},
+		{"hour range", "0 7-18 * * *", "2024-01-01 18:30", "2024-01-02 07:00"},
+		{"list", "30 8,12,17 * * *", "2024-01-01 12:30", "2024-01-01 17:30"},
+		{"weekdays", "0 9 * * 1-5", "2024-01-05 10:00", "2024-01-08 09:00"},
+		{"sunday as 0", "0 0 * * 0", "2024-01-01 00:00", "2024-01-07 00:00"},
+		{"sunday as 7", "0 0 * * 7", "2024-01-01 00:00", "2024-01-07 00:00"},
+		{"day of month", "0 0 1 * *", "2024-01-15 00:00", "2024-02-01 00:00"},
+		{"month list", "0 0 1 3,9 *", "2024-03-01 00:00", "2024-09-01 00:00"},
+		{"leap day", "0 0 29 2 *", "2024-03-01 00:00", "2028-02-29 00:00"},
+		// Both days restricted, either one matches
+		{"dom or dow, dow first", "0 0 13 * 5", "2024-01-01 00:00", "2024-01-05 00:00"},
+		{"dom or dow, dom first", "0 0 13 * 5", "2024-01-12 00:00", "2024-01-13 00:00"},
+		// A field starting with '*' isn't restricted, both must match
+		{"dom step and dow", "0 0 */2 * 1", "2024-01-01 00:00", "2024-01-15 00:00"},
+		{"dom and dow step", "0 0 15 * */1", "2024-01-01 00:00", "2024-01-15 00:00"},
+		{"never", "0 0 30 2 *", "2024-01-01 00:00", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := parseCron(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var expected time.Time
+			if tt.expected != "" {
+				expected = at(tt.expected)
+			}
+			if got := s.next(at(tt.from)); !got.Equal(expected) {
+				t.Errorf("next of %q from %s is %s, expected %s", tt.expr, tt.from, got, expected)
+			}
+		})
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	for _, expr := range []string{
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+		"1,,2 * * * *",
+	} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("%q parsed, expected an error", expr)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+)
+
+// type duplicateDetection finds the circulars published again with a different id and a slightly different title
+type duplicateDetection struct {
+	// threshold is the title similarity, from 0 to 1, from which two circulars are duplicates
+	threshold float64
+	// window is how far apart the published dates of two duplicates can be
+	window time.Duration
+}
+
+// type duplicate links a circular to the older one it repeats
+type duplicate struct {
+	id, originalId uint64
+	similarity     float64
+}
+
+// find returns the duplicates among the circulars: same category, published within window and similar titles.
+// The circular with the higher id is the duplicate. Circulars without a published date are never duplicates
+func (d *duplicateDetection) find(circulars []circular) []duplicate {
+	words := make([]map[string]bool, len(circulars))
+	for i, c := range circulars {
+		words[i] = titleWords(c.Title)
+	}
+
+	var duplicates []duplicate
+	for i, a := range circulars {
+		if a.PublishedDate.IsZero() {
+			continue
+		}
+		for j := i + 1; j < len(circulars); j++ {
+			b := circulars[j]
+			if b.PublishedDate.IsZero() || a.Category != b.Category || a.Id == b.Id {
+				continue
+			}
+			if gap := a.PublishedDate.Sub(b.PublishedDate); gap > d.window || gap < -d.window {
+				continue
+			}
+			similarity := wordsSimilarity(words[i], words[j])
+			if similarity < d.threshold {
+				continue
+			}
+			dup := duplicate{id: a.Id, originalId: b.Id, similarity: similarity}
+			if a.Id < b.Id {
+				dup.id, dup.originalId = b.Id, a.Id
+			}
+			duplicates = append(duplicates, dup)
+		}
+	}
+	return duplicates
+}
+
+// store logs and records the duplicates in circolare_duplicata, a link found again only gets its similarity updated
+func (d *duplicateDetection) store(ctx context.Context, db *sql.DB, duplicates []duplicate) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	for _, dup := range duplicates {
+		log.Printf("WARNING: circular %d looks like a duplicate of %d, title similarity %.2f", dup.id, dup.originalId, dup.similarity)
+		_, err := tx.ExecContext(ctx,
+			"INSERT INTO circolare_duplicata (id_circolare, id_originale, similarita, rilevata_il) VALUES (?, ?, ?, ?) ON DUPLICATE KEY UPDATE "+updateColumns("similarita"),
+			dup.id, dup.originalId, dup.similarity, now)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// purgeOrphanDuplicates deletes the links to circulars that aren't stored anymore, returning how many were deleted
+func purgeOrphanDuplicates(ctx context.Context, db *sql.DB) (int64, error) {
+	res, err := db.ExecContext(ctx,
+		"DELETE d FROM circolare_duplicata d LEFT JOIN circolare c ON c.`"+columns.id+"` = d.id_circolare LEFT JOIN circolare o ON o.`"+columns.id+"` = d.id_originale WHERE c.`"+columns.id+"` IS NULL OR o.`"+columns.id+"` IS NULL")
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDuplicateDetectionFind(t *testing.T) {
+	circulars, _ := parseFixture(t)
+	detection := duplicateDetection{threshold: 0.7, window: 7 * 24 * time.Hour}
+	if duplicates := detection.find(circulars); len(duplicates) != 0 {
+		t.Errorf("found duplicates %v in the fixture, expected none", duplicates)
+	}
+
+	// A copy with a new id and a longer title is a duplicate, a copy published out of the window isn't
+	copied := circulars[0]
+	copied.Id, copied.Title = copied.Id+100, copied.Title+" (rettifica)"
+	late := copied
+	late.Id, late.PublishedDate = late.Id+1, late.PublishedDate.AddDate(0, 0, 30)
+	duplicates := detection.find(append([]circular{copied, late}, circulars...))
+	if len(duplicates) != 1 || duplicates[0].id != copied.Id || duplicates[0].originalId != circulars[0].Id {
+		t.Errorf("found duplicates %v, expected only %d of %d", duplicates, copied.Id, circulars[0].Id)
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// defaultDownloadPath is the default path template of the downloaded attachments
+const defaultDownloadPath = "{year}/{circular_id}/{attachment_id}_{title}"
+
+// type downloader saves the attachments of the circulars under dir.
+// The path of each file comes from pathTemplate, whose placeholders are:
+// {year}, {month} -> published date of the circular, "unknown" when missing
+// {circular_id}, {attachment_id} -> ids
+// {title} -> title of the attachment
+// {category} -> category of the circular
+type downloader struct {
+	client       *http.Client
+	dir          string
+	pathTemplate string
+	// maxPerCircular is how many attachments of each circular are downloaded, the first ones shown. 0 for all
+	maxPerCircular int
+	// sem bounds the parallel downloads, it's shared by the schools processed in parallel
+	sem chan struct{}
+}
+
+// newDownloader returns a downloader running at most concurrency downloads in parallel
+func newDownloader(client *http.Client, dir, pathTemplate string, maxPerCircular, concurrency int) *downloader {
+	return &downloader{client: client, dir: dir, pathTemplate: pathTemplate, maxPerCircular: maxPerCircular, sem: make(chan struct{}, concurrency)}
+}
+
+// attachmentUrl returns the download url of the attachment
+func attachmentUrl(siteUrl string, id uint64) (string, error) {
+	return documentUrl(siteUrl, "akDOWNLOAD", id)
+}
+
+// storedAttachmentUrl returns the download url of a stored attachment, built from the url of its circular,
+// which addresses the same school. Returns sql.ErrNoRows when the attachment isn't stored or its circular is hidden
+func storedAttachmentUrl(db *sql.DB, id uint64) (string, error) {
+	col := columns
+	var circularUrl sql.NullString
+	err := db.QueryRow(
+		"SELECT c.`"+col.url+"` FROM circolare_allegato a JOIN circolare c ON c.`"+col.id+"` = a.`"+col.attachmentCircularId+"` WHERE a.`"+col.attachmentId+"` = ? AND c.`"+col.deletedAt+"` IS NULL",
+		id).Scan(&circularUrl)
+	if err != nil {
+		return "", err
+	}
+	return attachmentUrl(circularUrl.String, id)
+}
+
+// sanitizeFileName makes s safe as a single path component, replacing separators, reserved and control characters
+func sanitizeFileName(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r < 32 || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, s)
+	// Leading dots would hide the file or refer to parent dirs
+	s = strings.Trim(s, " .")
+	if r := []rune(s); len(r) > 100 {
+		s = strings.TrimRight(string(r[:100]), " .")
+	}
+	if s == "" {
+		return "_"
+	}
+	return s
+}
+
+// attachmentPath returns the path of the attachment relative to dir, expanding the template
+func (d *downloader) attachmentPath(c circular, att attachment) string {
+	year, month := "unknown", "unknown"
+	if !c.PublishedDate.IsZero() {
+		year = strconv.Itoa(c.PublishedDate.Year())
+		month = fmt.Sprintf("%02d", c.PublishedDate.Month())
+	}
+
+	// Each value is sanitized on its own, the template separators are kept
+	p := strings.NewReplacer(
+		"{year}", year,
+		"{month}", month,
+		"{circular_id}", strconv.FormatUint(c.Id, 10),
+		"{attachment_id}", strconv.FormatUint(att.Id, 10),
+		"{title}", sanitizeFileName(att.Title),
+		"{category}", sanitizeFileName(c.Category),
+	).Replace(d.pathTemplate)
+	return filepath.FromSlash(p)
+}
+
+// attachmentPaths returns the path of each attachment of the circular relative to dir.
+// When two attachments with different ids get the same path, e.g. same title and a template without {attachment_id},
+// the id is appended to the later one so neither is mistaken for the other
+func (d *downloader) attachmentPaths(c circular) []string {
+	paths := make([]string, len(c.Attachments))
+	taken := make(map[string]uint64)
+	for i, att := range c.Attachments {
+		p := d.attachmentPath(c, att)
+		if id, ok := taken[p]; ok && id != att.Id {
+			ext := filepath.Ext(p)
+			p = fmt.Sprintf("%s_%d%s", strings.TrimSuffix(p, ext), att.Id, ext)
+		}
+		taken[p] = att.Id
+		paths[i] = p
+	}
+	return paths
+}
+
+// download saves the attachment in relPath under dir, unless it has already been downloaded.
+// The file is written with a temporary name first, so a failed download isn't mistaken for a complete one.
+// The client has no overall timeout, ctx stops a stalled download
+func (d *downloader) download(ctx context.Context, siteUrl string, att attachment, relPath string) (downloaded bool, err error) {
+	p := filepath.Join(d.dir, relPath)
+	if _, err := os.Stat(p); err == nil {
+		return false, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return false, err
+	}
+
+	u, err := attachmentUrl(siteUrl, att.Id)
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return false, fmt.Errorf("attachment %d: status %s", att.Id, resp.Status)
+	}
+
+	tmp := p + ".part"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return false, err
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return false, err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return false, err
+	}
+	return true, os.Rename(tmp, p)
+}
+
+// downloadAll saves the attachments of all the circulars that haven't been downloaded yet.
+// Only the first maxPerCircular attachments of each circular are saved, the skipped ones are still stored in the DB.
+// The downloads run in parallel, a failed one doesn't stop the others. Once ctx is done no other download starts
+func (d *downloader) downloadAll(ctx context.Context, siteUrl string, circulars []circular) (downloaded, failed, skipped int) {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+jobs:
+	for _, c := range circulars {
+		paths := d.attachmentPaths(c)
+		attachments := c.Attachments
+		if d.maxPerCircular > 0 && len(attachments) > d.maxPerCircular {
+			log.Printf("INFO: circular %d, skipping %d of %d attachments", c.Id, len(attachments)-d.maxPerCircular, len(attachments))
+			skipped += len(attachments) - d.maxPerCircular
+			attachments = attachments[:d.maxPerCircular]
+		}
+		seen := make(map[string]bool)
+		for i, att := range attachments {
+			// A repeated attachment has the same path, downloading it twice in parallel would write the same file
+			if seen[paths[i]] {
+				continue
+			}
+			seen[paths[i]] = true
+			select {
+			case d.sem <- struct{}{}:
+			case <-ctx.Done():
+				break jobs
+			}
+			wg.Add(1)
+			go func(c circular, att attachment, p string) {
+				defer wg.Done()
+				defer func() { <-d.sem }()
+				// The slot could be taken right when ctx is done
+				if ctx.Err() != nil {
+					return
+				}
+				ok, err := func() (ok bool, err error) {
+					defer recoverPanic("download", &err)
+					return d.download(ctx, siteUrl, att, p)
+				}()
+
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil {
+					log.Printf("ERROR: can't download attachment %d of circular %d: %v", att.Id, c.Id, err)
+					failed++
+					return
+				}
+				if ok {
+					downloaded++
+				}
+			}(c, att, paths[i])
+		}
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		log.Printf("WARNING: attachment downloads stopped: %v", err)
+	}
+	return downloaded, failed, skipped
+}
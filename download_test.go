@@ -0,0 +1,34 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAttachmentPaths(t *testing.T) {
+	c := circular{
+		Id:            1002,
+		Category:      "Generale",
+		PublishedDate: time.Date(2023, time.September, 12, 0, 0, 0, 0, time.UTC),
+		Attachments:   []attachment{{Id: 2003, Title: "Orario.pdf"}, {Id: 2006, Title: "Orario.pdf"}, {Id: 2003, Title: "Orario.pdf"}, {Id: 2008, Title: "../a/b:c.pdf"}},
+	}
+	tests := []struct {
+		template string
+		expected []string
+	}{
+		{defaultDownloadPath, []string{"2023/1002/2003_Orario.pdf", "2023/1002/2006_Orario.pdf", "2023/1002/2003_Orario.pdf", "2023/1002/2008__a_b_c.pdf"}},
+		// Without {attachment_id} the id keeps the same titled attachments apart, a repeated one keeps its path
+		{"{circular_id}/{title}", []string{"1002/Orario.pdf", "1002/Orario_2006.pdf", "1002/Orario.pdf", "1002/_a_b_c.pdf"}},
+		{"{category}/{month}/{title}", []string{"Generale/09/Orario.pdf", "Generale/09/Orario_2006.pdf", "Generale/09/Orario.pdf", "Generale/09/_a_b_c.pdf"}},
+	}
+	for _, tt := range tests {
+		d := &downloader{pathTemplate: tt.template}
+		paths := d.attachmentPaths(c)
+		for i, p := range paths {
+			if expected := filepath.FromSlash(tt.expected[i]); p != expected {
+				t.Errorf("%s: path of attachment %d is %s, expected %s", tt.template, i, p, expected)
+			}
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// setDeleted sets or clears the deleted_at of the circular, a circular already deleted keeps its time.
+// The update time is set too, so /circulars/changes reports the change to the syncing clients.
+// Returns sql.ErrNoRows when the circular isn't stored
+func setDeleted(db *sql.DB, id uint64, deleted bool) error {
+	col := columns
+	var exists int
+	if err := db.QueryRow("SELECT 1 FROM circolare WHERE `"+col.id+"` = ?", id).Scan(&exists); err != nil {
+		return err
+	}
+	value := "NULL"
+	if deleted {
+		value = "COALESCE(`" + col.deletedAt + "`, NOW())"
+	}
+	_, err := db.Exec("UPDATE circolare SET `"+col.deletedAt+"` = "+value+", `"+col.updatedAt+"` = ? WHERE `"+col.id+"` = ?", time.Now().UTC().Format(dbTimeLayout), id)
+	return err
+}
+
+// type adminResult is the response of the admin endpoints
+type adminResult struct {
+	Id      uint64 `json:"id"`
+	Deleted bool   `json:"deleted"`
+}
+
+// handleAdmin hides a circular from the read endpoints, or shows it again. It stays in the DB and is still updated by the cycles.
+// POST /circulars/<id>/delete
+// POST /circulars/<id>/restore
+func (w *worker) handleAdmin(rw http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/circulars/"), "/")
+	if len(parts) != 2 || (parts[1] != "delete" && parts[1] != "restore") {
+		http.NotFound(rw, r)
+		return
+	}
+	id, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		http.Error(rw, "invalid circular id", http.StatusBadRequest)
+		return
+	}
+	deleted := parts[1] == "delete"
+
+	// The primary is written, the replica could lag
+	if err := setDeleted(w.db, id, deleted); err == sql.ErrNoRows {
+		http.Error(rw, "circular not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("ERROR: %v", err)
+		http.Error(rw, "can't update the circular", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("INFO: circular %d %sd by an operator", id, parts[1])
+
+	// The cache is filled again by the next cycle, the DB is read meanwhile.
+	// A fill reading the DB before the update is stored before this invalidate
+	w.cache.invalidate()
+
+	writeJSON(rw, adminResult{Id: id, Deleted: deleted})
+}
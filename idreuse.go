@@ -0,0 +1,58 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// type idReuseDetection flags the updates that would overwrite a stored circular with an unrelated one having the same id
+type idReuseDetection struct {
+	// threshold is the title similarity, from 0 to 1, below which the titles are unrelated. 0 disables the detection
+	threshold float64
+	// keepStored leaves the stored circular as it is, otherwise the reuse is only logged
+	keepStored bool
+}
+
+// idReuse is the detection used by insertCirculars, set at startup by CIRCULARS_ID_REUSE_THRESHOLD
+var idReuse idReuseDetection
+
+// titleWords returns the set of the lower case words of title
+func titleWords(title string) map[string]bool {
+	words := make(map[string]bool)
+	for _, w := range strings.FieldsFunc(strings.ToLower(title), func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsNumber(r) }) {
+		words[w] = true
+	}
+	return words
+}
+
+// titleSimilarity returns the Jaccard similarity of the words of the titles, 1 when they're the same
+func titleSimilarity(a, b string) float64 {
+	return wordsSimilarity(titleWords(a), titleWords(b))
+}
+
+// wordsSimilarity returns the Jaccard similarity of two sets of titleWords
+func wordsSimilarity(wa, wb map[string]bool) float64 {
+	if len(wa) == 0 && len(wb) == 0 {
+		return 1
+	}
+	common := 0
+	for w := range wa {
+		if wb[w] {
+			common++
+		}
+	}
+	return float64(common) / float64(len(wa)+len(wb)-common)
+}
+
+// suspected reports whether the parsed circular looks unrelated to the stored one with its id:
+// the titles are less similar than the threshold and, when both are known, the published dates differ.
+// An edited title alone keeps the date, so it isn't flagged
+func (d idReuseDetection) suspected(stored storedVersion, c circular) bool {
+	if d.threshold <= 0 || titleSimilarity(stored.title, c.Title) >= d.threshold {
+		return false
+	}
+	if stored.publishedDate == "" || c.PublishedDate.IsZero() {
+		return true
+	}
+	return stored.publishedDate != c.PublishedDate.Format("2006-01-02")
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+)
+
+// importBatchSize is how many circulars are inserted by a single transaction while importing
+const importBatchSize = 500
+
+// maxImportLineBytes is the max length of a single line of the imported file
+const maxImportLineBytes = 16 << 20
+
+// validateImported returns why the imported circular can't be stored, nil when it can
+func validateImported(c circular) error {
+	if c.Id == 0 {
+		return errors.New("missing Id")
+	}
+	if c.Title == "" {
+		return errors.New("missing Title")
+	}
+	if c.ValidUntilDate.IsZero() {
+		return errors.New("missing ValidUntilDate")
+	}
+	for _, att := range c.Attachments {
+		if att.Id == 0 {
+			return errors.New("attachment with missing Id")
+		}
+	}
+	return nil
+}
+
+// importJSONL inserts in the DB the circulars read from filename, a JSON encoded circular per line.
+// The imported data is the source of truth, so the circulars that are already stored get updated.
+// Malformed lines are skipped with a warning
+func importJSONL(db *sql.DB, filename string) (inserted, updated, skipped int, err error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	defer f.Close()
+
+	var batch []circular
+	flush := func() error {
+		ins, upd, err := insertCirculars(context.Background(), db, batch, upsertAll)
+		if err != nil {
+			return err
+		}
+		inserted += len(ins)
+		updated += upd
+		batch = batch[:0]
+		return nil
+	}
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxImportLineBytes)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var c circular
+		if err := json.Unmarshal(scanner.Bytes(), &c); err != nil {
+			log.Printf("WARNING: line %d isn't a valid circular: %v. Skipping", line, err)
+			skipped++
+			continue
+		}
+		if err := validateImported(c); err != nil {
+			log.Printf("WARNING: line %d: %v. Skipping", line, err)
+			skipped++
+			continue
+		}
+
+		batch = append(batch, c)
+		if len(batch) == importBatchSize {
+			if err := flush(); err != nil {
+				return inserted, updated, skipped, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return inserted, updated, skipped, err
+	}
+	if len(batch) > 0 {
+		if err := flush(); err != nil {
+			return inserted, updated, skipped, err
+		}
+	}
+	return inserted, updated, skipped, nil
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/xml"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultLatestLimit is the max number of circulars returned by /circulars and /feed
+const defaultLatestLimit = 50
+
+// type latestCircular is a circular returned by /circulars
+type latestCircular struct {
+	Id       uint64 `json:"id"`
+	Title    string `json:"title"`
+	Category string `json:"category"`
+	// PublishedDate and ValidUntil are yyyy-mm-dd, empty when unknown
+	PublishedDate string `json:"published_date"`
+	ValidUntil    string `json:"valid_until"`
+	ModifiedDate  string `json:"modified_date"`
+	Url           string `json:"url"`
+	Pinned        bool   `json:"pinned"`
+	Protocol      string `json:"protocol"`
+	// Recipients is empty when the circular isn't addressed to anyone in particular
+	Recipients []string `json:"recipients"`
+	SchoolYear string   `json:"school_year"`
+}
+
+// type circularsCache keeps the most recent stored circulars after the last successful cycle, so the reads don't hit the DB.
+// A nil cache is disabled and never hits
+type circularsCache struct {
+	// fillMu serializes fill and invalidate, so a fill that read the DB before a change can't be stored after its invalidate
+	fillMu sync.Mutex
+	mu     sync.RWMutex
+	size   int
+	// circulars are the most recent first, nil until the first successful cycle and after a failed one
+	circulars []latestCircular
+	// complete is true when circulars contains every stored circular, so it answers any limit
+	complete bool
+}
+
+// newCircularsCache returns a cache of the size most recent circulars, nil when size isn't positive
+func newCircularsCache(size int) *circularsCache {
+	if size <= 0 {
+		return nil
+	}
+	return &circularsCache{size: size}
+}
+
+// fill replaces the cached circulars with the most recent ones stored in the DB, so the cache returns what queryLatest does.
+// The cache is emptied when they can't be read
+func (c *circularsCache) fill(db *sql.DB) error {
+	if c == nil {
+		return nil
+	}
+	c.fillMu.Lock()
+	defer c.fillMu.Unlock()
+
+	latest, err := queryLatest(db, c.size)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		c.circulars, c.complete = nil, false
+		return err
+	}
+	c.circulars, c.complete = latest, len(latest) < c.size
+	return nil
+}
+
+// invalidate empties the cache, the DB may have been changed by a cycle that didn't succeed or by an operator
+func (c *circularsCache) invalidate() {
+	if c == nil {
+		return
+	}
+	c.fillMu.Lock()
+	defer c.fillMu.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.circulars, c.complete = nil, false
+}
+
+// latest returns the limit most recent circulars, ok is false when the cache can't answer
+func (c *circularsCache) latest(limit int) (circulars []latestCircular, ok bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.circulars == nil || (limit > len(c.circulars) && !c.complete) {
+		return nil, false
+	}
+	if limit > len(c.circulars) {
+		limit = len(c.circulars)
+	}
+	// The cached slice is never modified, it's replaced, so it can be shared
+	return c.circulars[:limit], true
+}
+
+// latestColumns are the columns scanned by scanLatest
+func latestColumns() string {
+	col := columns
+	return "`" + col.id + "` id, `" + col.title + "`, `" + col.category + "`, `" + col.publishedDate + "` published, `" + col.validUntilDate + "` valid_until, `" + col.url + "`, `" + col.pinned + "`, `" + col.protocol + "`, `" + col.recipients + "`, `" + col.schoolYear + "`, `" + col.modifiedDate + "` modified"
+}
+
+// queryLatest returns the limit most recent circulars from the DB, the circulars without a published date last.
+// The circulars hidden by an operator are left out, as by queryActive
+func queryLatest(db *sql.DB, limit int) ([]latestCircular, error) {
+	rows, err := db.Query("SELECT "+latestColumns()+" FROM circolare WHERE `"+columns.deletedAt+"` IS NULL ORDER BY published IS NULL, published DESC, id DESC LIMIT ?", limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanLatest(rows)
+}
+
+// queryActive returns the limit most recent circulars still valid on the day of now.
+// When inclusive, a circular is valid through the whole day of its valid until date, otherwise only up to its start
+func queryActive(db *sql.DB, now time.Time, inclusive bool, limit int) ([]latestCircular, error) {
+	cmp := ">"
+	if inclusive {
+		cmp = ">="
+	}
+	rows, err := db.Query(
+		"SELECT "+latestColumns()+" FROM circolare WHERE `"+columns.deletedAt+"` IS NULL AND `"+columns.validUntilDate+"` "+cmp+" ? ORDER BY published IS NULL, published DESC, id DESC LIMIT ?",
+		now.Format("2006-01-02"),
+		limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanLatest(rows)
+}
+
+// scanLatest returns the circulars of the rows selected with latestColumns, then closes them
+func scanLatest(rows *sql.Rows) ([]latestCircular, error) {
+	defer rows.Close()
+
+	latest := []latestCircular{}
+	for rows.Next() {
+		var c latestCircular
+		var published, validUntil, u, protocol, recipients, year, modified sql.NullString
+		if err := rows.Scan(&c.Id, &c.Title, &c.Category, &published, &validUntil, &u, &c.Pinned, &protocol, &recipients, &year, &modified); err != nil {
+			return nil, err
+		}
+		c.ModifiedDate = modified.String
+		c.PublishedDate, c.ValidUntil, c.Url, c.Protocol, c.SchoolYear = published.String, validUntil.String, u.String, protocol.String, year.String
+		c.Recipients = []string{}
+		if recipients.Valid {
+			c.Recipients = splitRecipients(recipients.String)
+		}
+		latest = append(latest, c)
+	}
+	return latest, rows.Err()
+}
+
+// type rssFeed is the RSS 2.0 document returned by /feed
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+// type rssChannel is the channel of rssFeed
+type rssChannel struct {
+	Title       string    `xml:"title"`
+	Link        string    `xml:"link"`
+	Description string    `xml:"description"`
+	Items       []rssItem `xml:"item"`
+}
+
+// type rssItem is a circular of rssChannel
+type rssItem struct {
+	Title    string  `xml:"title"`
+	Link     string  `xml:"link,omitempty"`
+	Guid     rssGuid `xml:"guid"`
+	PubDate  string  `xml:"pubDate,omitempty"`
+	Category string  `xml:"category,omitempty"`
+}
+
+// type rssGuid identifies an rssItem by the circular id
+type rssGuid struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+// newRSSFeed returns the feed of the circulars, link is the page of the channel
+func newRSSFeed(link string, circulars []latestCircular) rssFeed {
+	feed := rssFeed{Version: "2.0", Channel: rssChannel{
+		Title:       "Circolari",
+		Link:        link,
+		Description: "Latest circulars of the segreteria digitale",
+		Items:       []rssItem{},
+	}}
+	for _, c := range circulars {
+		item := rssItem{Title: c.Title, Link: c.Url, Guid: rssGuid{Value: strconv.FormatUint(c.Id, 10)}, Category: c.Category}
+		if d, err := time.Parse("2006-01-02", c.PublishedDate); err == nil {
+			item.PubDate = d.Format(time.RFC1123Z)
+		}
+		feed.Channel.Items = append(feed.Channel.Items, item)
+	}
+	return feed
+}
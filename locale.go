@@ -0,0 +1,43 @@
+package main
+
+import "regexp"
+
+// type locale contains the format sensitive strings used for parsing the circulars.
+// Each Spaggiari deployment shows dates and labels in its own language
+type locale struct {
+	// dateLayout is the time.Parse layout of the shown dates
+	dateLayout string
+	// Labels preceding the spans with the circular fields
+	categoryLabel   string
+	publishedLabel  string
+	validUntilLabel string
+	// attachmentPlaceholder is the title of the attachments without one, followed by their id
+	attachmentPlaceholder string
+	// protocolLabel precedes the span with the protocol number, when the circular has one
+	protocolLabel string
+	// protocolPattern finds the protocol number in the title, its first group is the number
+	protocolPattern *regexp.Regexp
+	// recipientsLabel precedes the span with the recipients, when the circular is addressed to some of them
+	recipientsLabel string
+	// modifiedLabel precedes the span with the last modified date, shown only for the edited circulars
+	modifiedLabel string
+}
+
+// locales contains the supported locales, selectable with CIRCULARS_LOCALE
+var locales = map[string]locale{
+	"it": {
+		dateLayout:            "02/01/2006",
+		categoryLabel:         "Categoria",
+		publishedLabel:        "Pubblicato il",
+		validUntilLabel:       "Valido fino",
+		attachmentPlaceholder: "Allegato",
+		protocolLabel:         "Protocollo",
+		// e.g. "Prot. n. 1234/2023", "protocollo n° 567/A1", "prot.1234"
+		protocolPattern: regexp.MustCompile(`(?i)\bprot(?:ocollo|\.)?\s*(?:n(?:r|um)?\.?|n°|nº)?\s*:?\s*(\d[\w/.-]*)`),
+		recipientsLabel: "Destinatari",
+		modifiedLabel:   "Modificato il",
+	},
+}
+
+// defaultLocale is used when CIRCULARS_LOCALE isn't set
+const defaultLocale = "it"
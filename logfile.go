@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// type rotatingFile is a log destination that rotates the file when it exceeds maxBytes.
+// Rotated files are renamed path.1, path.2, ... keeping at most maxBackups of them
+type rotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxBytes   int64
+	maxBackups int
+	f          *os.File
+	size       int64
+}
+
+// openRotatingFile opens path for appending, creating it when missing
+func openRotatingFile(path string, maxBytes int64, maxBackups int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxBytes: maxBytes, maxBackups: maxBackups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f = f
+	r.size = info.Size()
+	return nil
+}
+
+// rotate shifts the backups by one, dropping the oldest, and starts a new file
+func (r *rotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	for i := r.maxBackups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+	}
+	if r.maxBackups > 0 {
+		os.Rename(r.path, r.path+".1")
+	} else {
+		os.Remove(r.path)
+	}
+	return r.open()
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.size > 0 && r.size+int64(len(p)) > r.maxBytes {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// Close flushes the file to disk and closes it
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.f.Sync(); err != nil {
+		r.f.Close()
+		return err
+	}
+	return r.f.Close()
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Metrics are published with expvar and exposed by the HTTP server at /debug/vars
+var (
+	// metricExpectedCirculars is the number of circulars reported by the server in the last cycle
+	metricExpectedCirculars = expvar.NewInt("circulars_expected")
+	// metricParsedCirculars is the number of circulars parsed in the last cycle
+	metricParsedCirculars = expvar.NewInt("circulars_parsed")
+	// metricParsingGap is the number of circulars reported by the server that couldn't be parsed in the last cycle
+	metricParsingGap = expvar.NewInt("circulars_parsing_gap")
+
+	// Totals since startup, incremented only after the data has been committed
+	metricInsertedCirculars = expvar.NewInt("circulars_inserted_total")
+	metricUpdatedCirculars  = expvar.NewInt("circulars_updated_total")
+	// metricSkippedUpdates counts the updates skipped since the content hash of the circular didn't change
+	metricSkippedUpdates    = expvar.NewInt("circulars_update_skipped_total")
+	metricNotifiedCirculars = expvar.NewInt("circulars_notified_total")
+	// Rows actually deleted by the cleanup
+	metricDeletedCirculars   = expvar.NewInt("circulars_deleted_total")
+	metricDeletedAttachments = expvar.NewInt("attachments_deleted_total")
+	// metricParseErrors counts the circular rows skipped while parsing, by field
+	metricParseErrors = expvar.NewMap("parse_errors_total")
+	// metricIdReuseSuspected counts the updates whose circular looks different from the stored one with the same id
+	metricIdReuseSuspected = expvar.NewInt("id_reuse_suspected_total")
+	// metricPanics is the number of recovered panics
+	metricPanics = expvar.NewInt("panics_total")
+
+	// metricBreakerState is the state of the fetch circuit breaker of each school, set once the breakers are created
+	metricBreakerState = &lazyFunc{}
+
+	// Durations of the whole cycle and of each of its stages. Fetch, parse and insert are observed once per school
+	metricCycleDuration  = newHistogram("cycle_duration_seconds", durationBuckets)
+	metricFetchDuration  = newHistogram("fetch_duration_seconds", durationBuckets)
+	metricParseDuration  = newHistogram("parse_duration_seconds", durationBuckets)
+	metricInsertDuration = newHistogram("insert_duration_seconds", durationBuckets)
+	metricDeleteDuration = newHistogram("delete_duration_seconds", durationBuckets)
+)
+
+func init() {
+	expvar.Publish("breaker_state", metricBreakerState)
+}
+
+// type lazyFunc is an expvar.Func whose function is set after publishing it, null until then
+type lazyFunc struct {
+	mu sync.Mutex
+	f  func() interface{}
+}
+
+// Set sets the function returning the value
+func (l *lazyFunc) Set(f func() interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.f = f
+}
+
+func (l *lazyFunc) String() string {
+	l.mu.Lock()
+	f := l.f
+	l.mu.Unlock()
+	if f == nil {
+		return "null"
+	}
+	return expvar.Func(f).String()
+}
+
+// durationBuckets are the upper bounds, in seconds, of the duration histograms buckets
+var durationBuckets = []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+// type histogram counts the observed values in cumulative buckets, as an expvar.Var
+type histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	// counts has one more element than buckets, for the values above the last bucket
+	counts []int64
+	count  int64
+	sum    float64
+}
+
+// newHistogram creates a histogram with the buckets upper bounds and publishes it with name
+func newHistogram(name string, buckets []float64) *histogram {
+	h := &histogram{buckets: buckets, counts: make([]int64, len(buckets)+1)}
+	expvar.Publish(name, h)
+	return h
+}
+
+// observe adds a duration to the histogram, in seconds
+func (h *histogram) observe(d time.Duration) {
+	v := d.Seconds()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	i := 0
+	for i < len(h.buckets) && v > h.buckets[i] {
+		i++
+	}
+	h.counts[i]++
+	h.count++
+	h.sum += v
+}
+
+// String returns the histogram as JSON, with the cumulative count of each bucket
+func (h *histogram) String() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	buckets := make(map[string]int64, len(h.counts))
+	var cumulative int64
+	for i, c := range h.counts {
+		cumulative += c
+		le := "+Inf"
+		if i < len(h.buckets) {
+			le = strconv.FormatFloat(h.buckets[i], 'f', -1, 64)
+		}
+		buckets[le] = cumulative
+	}
+
+	b, _ := json.Marshal(struct {
+		Count   int64            `json:"count"`
+		Sum     float64          `json:"sum"`
+		Buckets map[string]int64 `json:"buckets"`
+	}{h.count, h.sum, buckets})
+	return string(b)
+}
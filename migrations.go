@@ -0,0 +1,237 @@
+package main
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// migrationFiles are the schema migrations of every backend, in migrations/<dialect>/NNNN_description.sql.
+// Their column names are written as {logical} placeholders, replaced by the column mapping
+//
+//go:embed migrations
+var migrationFiles embed.FS
+
+// dbDriver is the database/sql driver of the DB, and the dialect of its migrations
+const dbDriver = "mysql"
+
+// type migration is a schema migration, applied once in the order of the versions
+type migration struct {
+	version    int
+	name       string
+	statements []string
+}
+
+// loadMigrations returns the migrations of the dialect sorted by version, with the placeholders replaced by the mapped columns
+func loadMigrations(dialect string, m columnMapping) ([]migration, error) {
+	dir := path.Join("migrations", dialect)
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, fmt.Errorf("no migrations for %s", dialect)
+	}
+
+	pairs := make([]string, 0, 2*len(m.list()))
+	for _, c := range m.list() {
+		pairs = append(pairs, "{"+c.logical+"}", *c.name)
+	}
+	placeholders := strings.NewReplacer(pairs...)
+
+	var migrations []migration
+	seen := make(map[int]string)
+	for _, e := range entries {
+		if e.IsDir() || path.Ext(e.Name()) != ".sql" {
+			continue
+		}
+		name := strings.TrimSuffix(e.Name(), ".sql")
+		i := strings.Index(name, "_")
+		if i < 0 {
+			return nil, fmt.Errorf("migration %s isn't named NNNN_description.sql", e.Name())
+		}
+		version, err := strconv.Atoi(name[:i])
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration %s isn't named NNNN_description.sql", e.Name())
+		}
+		if other, exists := seen[version]; exists {
+			return nil, fmt.Errorf("migrations %s and %s have the same version", other, e.Name())
+		}
+		seen[version] = e.Name()
+
+		content, err := fs.ReadFile(migrationFiles, path.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, migration{version, name, splitStatements(placeholders.Replace(string(content)))})
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+	return migrations, nil
+}
+
+// splitStatements splits a migration in its statements, each ending with ';' at the end of a line.
+// The driver runs a single statement per query. Lines starting with '--' are comments
+func splitStatements(content string) []string {
+	var statements []string
+	var current strings.Builder
+	for _, line := range strings.Split(content, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+		current.WriteString(line)
+		current.WriteString("\n")
+		if strings.HasSuffix(trimmed, ";") {
+			statements = append(statements, strings.TrimSuffix(strings.TrimSpace(current.String()), ";"))
+			current.Reset()
+		}
+	}
+	if rest := strings.TrimSpace(current.String()); rest != "" {
+		statements = append(statements, rest)
+	}
+	return statements
+}
+
+// migrateDB applies the migrations newer than the version recorded in schema_migrations, it's created when missing.
+// MySQL commits every DDL statement on its own, so a failed migration isn't recorded and must be fixed by hand before retrying
+func migrateDB(db *sql.DB, dialect string, m columnMapping) error {
+	migrations, err := loadMigrations(dialect, m)
+	if err != nil {
+		return err
+	}
+
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS `schema_migrations` (" +
+		"`version` INT NOT NULL PRIMARY KEY, " +
+		"`name` VARCHAR(255) NOT NULL, " +
+		"`applied_at` DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP)"); err != nil {
+		return err
+	}
+	var current int
+	if err := db.QueryRow("SELECT COALESCE(MAX(`version`), 0) FROM `schema_migrations`").Scan(&current); err != nil {
+		return err
+	}
+	// Migration 1 creates the tables only when missing, the ones created before the migrations get its columns here
+	if err := upgradeBaseline(db, m); err != nil {
+		return fmt.Errorf("upgrading the tables created before the migrations: %w", err)
+	}
+
+	latest := 0
+	if len(migrations) > 0 {
+		latest = migrations[len(migrations)-1].version
+	}
+	if current > latest {
+		log.Printf("WARNING: schema version %d is newer than the latest known %d, it was migrated by a newer version", current, latest)
+		return nil
+	}
+
+	for _, mig := range migrations {
+		if mig.version <= current {
+			continue
+		}
+		log.Printf("INFO: applying migration %s", mig.name)
+		for _, statement := range mig.statements {
+			if _, err := db.Exec(statement); err != nil {
+				return fmt.Errorf("migration %s: %w", mig.name, err)
+			}
+		}
+		if _, err := db.Exec("INSERT INTO `schema_migrations` (`version`, `name`) VALUES (?, ?)", mig.version, mig.name); err != nil {
+			return fmt.Errorf("migration %s: %w", mig.name, err)
+		}
+	}
+	log.Printf("INFO: schema at version %d", latest)
+	return nil
+}
+
+// type baselineColumn is a column created by migration 1 that's missing from the tables created before the migrations
+type baselineColumn struct {
+	logical, table, definition string
+}
+
+// baselineColumns are the columns of migration 1 missing from the baseline tables, that have only
+// id, titolo, categoria, data, valida_fino, aggiunta_il and id_allegato, titolo, id_circolare
+var baselineColumns = []baselineColumn{
+	{"published_date_raw", "circolare", "VARCHAR(64) NOT NULL DEFAULT ''"},
+	{"url", "circolare", "VARCHAR(512) NOT NULL DEFAULT ''"},
+	{"extra", "circolare", "JSON NULL"},
+	{"pinned", "circolare", "TINYINT(1) NOT NULL DEFAULT 0"},
+	{"protocol", "circolare", "VARCHAR(64) NULL"},
+	{"updated_at", "circolare", "DATETIME NULL"},
+	{"missing_since", "circolare", "DATETIME NULL"},
+	{"attachment_sort_order", "circolare_allegato", "INT NOT NULL DEFAULT 0"},
+	{"attachment_size", "circolare_allegato", "BIGINT UNSIGNED NULL"},
+}
+
+// upgradeBaseline brings the tables created before the migrations to the shape of migration 1, adding the missing
+// baselineColumns and making the published date nullable. It does nothing when the tables don't exist yet or are up to date
+func upgradeBaseline(db *sql.DB, m columnMapping) error {
+	exists, err := tableExists(db, "circolare")
+	if err != nil || !exists {
+		return err
+	}
+
+	names := make(map[string]string)
+	for _, c := range m.list() {
+		names[c.logical] = *c.name
+	}
+	tables := map[string]bool{"circolare": true}
+	for _, c := range baselineColumns {
+		if _, checked := tables[c.table]; !checked {
+			if tables[c.table], err = tableExists(db, c.table); err != nil {
+				return err
+			}
+		}
+		// The missing tables are created by migration 1
+		if !tables[c.table] {
+			continue
+		}
+		exists, err := columnExists(db, c.table, names[c.logical])
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		log.Printf("INFO: adding the column %s.%s", c.table, names[c.logical])
+		if _, err := db.Exec("ALTER TABLE `" + c.table + "` ADD COLUMN `" + names[c.logical] + "` " + c.definition); err != nil {
+			return err
+		}
+	}
+
+	// The circulars without a parsable date are stored with a NULL date
+	var nullable string
+	err = db.QueryRow(
+		"SELECT IS_NULLABLE FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'circolare' AND COLUMN_NAME = ?",
+		m.publishedDate).Scan(&nullable)
+	if err != nil {
+		return err
+	}
+	if nullable == "NO" {
+		log.Printf("INFO: making the column circolare.%s nullable", m.publishedDate)
+		if _, err := db.Exec("ALTER TABLE `circolare` MODIFY `" + m.publishedDate + "` DATE NULL"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tableExists reports whether the table is in the DB
+func tableExists(db *sql.DB, table string) (bool, error) {
+	var count int
+	err := db.QueryRow(
+		"SELECT COUNT(*) FROM information_schema.TABLES WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ?",
+		table).Scan(&count)
+	return count > 0, err
+}
+
+// columnExists reports whether the column is in the table
+func columnExists(db *sql.DB, table, column string) (bool, error) {
+	var count int
+	err := db.QueryRow(
+		"SELECT COUNT(*) FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?",
+		table,
+		column).Scan(&count)
+	return count > 0, err
+}
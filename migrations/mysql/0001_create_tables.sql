@@ -0,0 +1,29 @@
+-- The tables of the circulars and of their attachments.
+-- IF NOT EXISTS keeps the tables created before the migrations, upgradeBaseline adds them the missing columns
+CREATE TABLE IF NOT EXISTS `circolare` (
+	`{id}` BIGINT UNSIGNED NOT NULL,
+	`{title}` VARCHAR(255) NOT NULL,
+	`{category}` VARCHAR(255) NOT NULL,
+	`{published_date}` DATE NULL,
+	`{published_date_raw}` VARCHAR(64) NOT NULL DEFAULT '',
+	`{valid_until}` DATE NULL,
+	`{url}` VARCHAR(512) NOT NULL DEFAULT '',
+	`{extra}` JSON NULL,
+	`{pinned}` TINYINT(1) NOT NULL DEFAULT 0,
+	`{protocol}` VARCHAR(64) NULL,
+	`{added_at}` DATETIME NOT NULL,
+	`{updated_at}` DATETIME NULL,
+	`{missing_since}` DATETIME NULL,
+	PRIMARY KEY (`{id}`),
+	KEY `idx_data` (`{published_date}`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS `circolare_allegato` (
+	`{attachment_id}` BIGINT UNSIGNED NOT NULL,
+	`{attachment_title}` VARCHAR(255) NOT NULL,
+	`{attachment_circular_id}` BIGINT UNSIGNED NOT NULL,
+	`{attachment_sort_order}` INT NOT NULL DEFAULT 0,
+	`{attachment_size}` BIGINT UNSIGNED NULL,
+	PRIMARY KEY (`{attachment_id}`),
+	KEY `idx_circolare` (`{attachment_circular_id}`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
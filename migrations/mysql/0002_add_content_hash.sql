@@ -0,0 +1,2 @@
+-- The hash of the parsed values, the unchanged circulars aren't updated. See contentHash
+ALTER TABLE `circolare` ADD COLUMN `{content_hash}` CHAR(64) NULL;
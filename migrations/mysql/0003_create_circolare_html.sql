@@ -0,0 +1,6 @@
+-- The gzipped html of the row of each circular, stored only with CIRCULARS_STORE_RAW_HTML
+CREATE TABLE IF NOT EXISTS `circolare_html` (
+	`id_circolare` BIGINT UNSIGNED NOT NULL,
+	`html` MEDIUMBLOB NOT NULL,
+	PRIMARY KEY (`id_circolare`)
+) ENGINE=InnoDB;
@@ -0,0 +1,2 @@
+-- The normalized recipients of the circular, comma separated. See parseRecipients
+ALTER TABLE `circolare` ADD COLUMN `{recipients}` VARCHAR(255) NULL;
@@ -0,0 +1,10 @@
+-- The circulars skipped while parsing, one row per circular and field. See storeRejected
+CREATE TABLE IF NOT EXISTS `circolare_scartata` (
+	`id_circolare` BIGINT UNSIGNED NOT NULL,
+	`url_sito` VARCHAR(512) NOT NULL,
+	`campo` VARCHAR(64) NOT NULL,
+	`motivo` VARCHAR(255) NOT NULL,
+	`scartata_il` DATETIME NOT NULL,
+	`ultima_il` DATETIME NOT NULL,
+	PRIMARY KEY (`id_circolare`, `url_sito`, `campo`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
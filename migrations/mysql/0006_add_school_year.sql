@@ -0,0 +1,3 @@
+-- The school year of the circular, e.g. 2023/2024. See schoolYear
+ALTER TABLE `circolare` ADD COLUMN `{school_year}` VARCHAR(9) NULL,
+	ADD KEY `idx_anno_scolastico` (`{school_year}`);
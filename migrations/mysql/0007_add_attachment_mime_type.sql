@@ -0,0 +1,2 @@
+-- The Content-Type of the attachment, got with CIRCULARS_PROBE_ATTACHMENTS. See attachmentProber
+ALTER TABLE `circolare_allegato` ADD COLUMN `{attachment_mime_type}` VARCHAR(255) NULL;
@@ -0,0 +1,9 @@
+-- The circulars that look like a repeated publication of an older one. See duplicateDetection
+CREATE TABLE IF NOT EXISTS `circolare_duplicata` (
+	`id_circolare` BIGINT UNSIGNED NOT NULL,
+	`id_originale` BIGINT UNSIGNED NOT NULL,
+	`similarita` DECIMAL(4,3) NOT NULL,
+	`rilevata_il` DATETIME NOT NULL,
+	PRIMARY KEY (`id_circolare`, `id_originale`),
+	KEY `idx_originale` (`id_originale`)
+) ENGINE=InnoDB;
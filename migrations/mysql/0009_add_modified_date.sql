@@ -0,0 +1,2 @@
+-- The last modified date shown for the edited circulars
+ALTER TABLE `circolare` ADD COLUMN `{modified_date}` DATE NULL;
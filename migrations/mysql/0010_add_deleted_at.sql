@@ -0,0 +1,2 @@
+-- When the circular was hidden by an operator with POST /circulars/{id}/delete, NULL while it's shown
+ALTER TABLE `circolare` ADD COLUMN `{deleted_at}` DATETIME NULL;
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// baselineDDL are the tables as created before the migrations, with the default column names
+var baselineDDL = []string{
+	"CREATE TABLE `circolare` (" +
+		"`id` BIGINT UNSIGNED NOT NULL, " +
+		"`titolo` VARCHAR(255) NOT NULL, " +
+		"`categoria` VARCHAR(255) NOT NULL, " +
+		"`data` DATE NOT NULL, " +
+		"`valida_fino` DATE NULL, " +
+		"`aggiunta_il` DATETIME NOT NULL, " +
+		"PRIMARY KEY (`id`)) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4",
+	"CREATE TABLE `circolare_allegato` (" +
+		"`id_allegato` BIGINT UNSIGNED NOT NULL, " +
+		"`titolo` VARCHAR(255) NOT NULL, " +
+		"`id_circolare` BIGINT UNSIGNED NOT NULL, " +
+		"PRIMARY KEY (`id_allegato`)) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4",
+}
+
+// baselineLogical are the logical names of the columns of baselineDDL
+var baselineLogical = []string{
+	"id", "title", "category", "published_date", "valid_until", "added_at",
+	"attachment_id", "attachment_title", "attachment_circular_id",
+}
+
+func TestBaselineColumnsCompleteMigration1(t *testing.T) {
+	content, err := migrationFiles.ReadFile("migrations/mysql/0001_create_tables.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inBaseline := make(map[string]bool)
+	for _, logical := range baselineLogical {
+		inBaseline[logical] = true
+	}
+	var expected []string
+	for _, match := range regexp.MustCompile("(?m)^\\s*`\\{([a-z_]+)\\}`").FindAllStringSubmatch(string(content), -1) {
+		if !inBaseline[match[1]] {
+			expected = append(expected, match[1])
+		}
+	}
+	var got []string
+	for _, c := range baselineColumns {
+		got = append(got, c.logical)
+	}
+	sort.Strings(expected)
+	sort.Strings(got)
+	if strings.Join(got, ",") != strings.Join(expected, ",") {
+		t.Errorf("baselineColumns are %v, migration 1 adds %v to the baseline", got, expected)
+	}
+}
+
+// openTestDB returns the DB of CIRCULARS_TEST_DB_CONNECTION_STRING without any table, skipping the test when it isn't set.
+// It must be a throwaway DB, the tables are dropped again at the end of the test
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	connectionString := os.Getenv("CIRCULARS_TEST_DB_CONNECTION_STRING")
+	if connectionString == "" {
+		t.Skip("CIRCULARS_TEST_DB_CONNECTION_STRING isn't set")
+	}
+	db, err := sql.Open(dbDriver, connectionString)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tables := []string{"schema_migrations", "circolare", "circolare_allegato", "circolare_html", "circolare_scartata", "circolare_duplicata"}
+	dropTables := func() {
+		for _, table := range tables {
+			if _, err := db.Exec("DROP TABLE IF EXISTS `" + table + "`"); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	dropTables()
+	t.Cleanup(func() {
+		dropTables()
+		db.Close()
+	})
+	return db
+}
+
+func TestMigrateDBFromBaseline(t *testing.T) {
+	db := openTestDB(t)
+	for _, statement := range baselineDDL {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Twice, the second run must find everything up to date
+	for i := 0; i < 2; i++ {
+		if err := migrateDB(db, dbDriver, defaultColumns()); err != nil {
+			t.Fatalf("run %d: %v", i+1, err)
+		}
+	}
+	if err := checkColumns(db, defaultColumns(), true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO `circolare` (`id`, `titolo`, `categoria`, `data`, `aggiunta_il`) VALUES (1, 'Titolo', 'Categoria', NULL, NOW())"); err != nil {
+		t.Errorf("the published date isn't nullable: %v", err)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// type notifier sends the new circulars somewhere, giving up once ctx is done
+type notifier interface {
+	notify(ctx context.Context, circulars []circular) error
+}
+
+// type webhookOptions changes how the webhooks are delivered
+type webhookOptions struct {
+	// secret signs the payloads, no signature when empty
+	secret string
+	// retries is how many times a failed delivery is retried, with an exponential backoff
+	retries int
+}
+
+// webhookRetryWait is the wait before the first retry, doubled at each one
+const webhookRetryWait = time.Second
+
+// type webhookNotifier posts the circulars as JSON to url: {"circulars": [...]}.
+// Deliveries are at-least-once: a retried payload could have already been received, so receivers must be idempotent.
+// Every attempt of a payload has the same X-Delivery-Id header, and with a secret the X-Signature header is
+// "sha256=" followed by the hex HMAC-SHA256 of the body
+type webhookNotifier struct {
+	client *http.Client
+	url    string
+	opts   webhookOptions
+}
+
+func newWebhookNotifier(url string, opts webhookOptions) *webhookNotifier {
+	return &webhookNotifier{client: &http.Client{Timeout: 10 * time.Second}, url: url, opts: opts}
+}
+
+// sign returns the X-Signature of body
+func (n *webhookNotifier) sign(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(n.opts.secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliver posts the body once, returning whether a failure can be retried
+func (n *webhookNotifier) deliver(ctx context.Context, body []byte, deliveryId string) (retry bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", n.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Delivery-Id", deliveryId)
+	if n.opts.secret != "" {
+		req.Header.Set("X-Signature", n.sign(body))
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		// Client errors won't change by retrying, except for rate limiting
+		retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return retry, fmt.Errorf("webhook responded with status %s", resp.Status)
+	}
+	return false, nil
+}
+
+// notify delivers the circulars. The retries run inside the cycle, so their backoff stops once ctx is done
+func (n *webhookNotifier) notify(ctx context.Context, circulars []circular) error {
+	body, err := json.Marshal(struct {
+		Circulars []circular `json:"circulars"`
+	}{circulars})
+	if err != nil {
+		return err
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	deliveryId := hex.EncodeToString(id)
+
+	wait := webhookRetryWait
+	for attempt := 0; ; attempt++ {
+		retry, err := n.deliver(ctx, body, deliveryId)
+		if err == nil || !retry || attempt == n.opts.retries {
+			return err
+		}
+		log.Printf("WARNING: %v, retrying the webhook in %v (%d/%d)", err, wait, attempt+1, n.opts.retries)
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("webhook not delivered: %w", ctx.Err())
+		}
+		wait *= 2
+	}
+}
+
+// type categoryRouter sends each circular to the notifier of its category, compared case insensitively.
+// Circulars of unmatched categories go to fallback, or nowhere when it's nil
+type categoryRouter struct {
+	routes   map[string]notifier
+	fallback notifier
+}
+
+func (r *categoryRouter) notify(ctx context.Context, circulars []circular) error {
+	// Group the circulars so each notifier is called once
+	var order []notifier
+	groups := make(map[notifier][]circular)
+	for _, c := range circulars {
+		n, exists := r.routes[strings.ToLower(strings.TrimSpace(c.Category))]
+		if !exists {
+			n = r.fallback
+		}
+		if n == nil {
+			continue
+		}
+		if _, exists := groups[n]; !exists {
+			order = append(order, n)
+		}
+		groups[n] = append(groups[n], c)
+	}
+
+	// A failing channel doesn't stop the others
+	var failed int
+	for _, n := range order {
+		if err := n.notify(ctx, groups[n]); err != nil {
+			log.Printf("ERROR: notification failed: %v", err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d notifications failed", failed, len(order))
+	}
+	return nil
+}
+
+// type routesConfig is the file format of CIRCULARS_NOTIFY_ROUTES_FILE
+// {"Default": "https://hooks.example/all", "Routes": {"Didattica": "https://hooks.example/teachers"}}
+type routesConfig struct {
+	// Default = webhook url of the categories without a route, optional
+	Default string
+	// Routes = webhook url of each category
+	Routes map[string]string
+}
+
+// loadCategoryRouter loads the routes from file, fallbackUrl is used when the file has no default
+func loadCategoryRouter(filename, fallbackUrl string, opts webhookOptions) (*categoryRouter, error) {
+	routesFile, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer routesFile.Close()
+
+	var config routesConfig
+	if err := json.NewDecoder(routesFile).Decode(&config); err != nil {
+		return nil, err
+	}
+	if config.Default == "" {
+		config.Default = fallbackUrl
+	}
+
+	// Categories sharing a url share the notifier too
+	notifiers := make(map[string]notifier)
+	notifierFor := func(url string) notifier {
+		if _, exists := notifiers[url]; !exists {
+			notifiers[url] = newWebhookNotifier(url, opts)
+		}
+		return notifiers[url]
+	}
+
+	router := &categoryRouter{routes: make(map[string]notifier)}
+	for category, url := range config.Routes {
+		router.routes[strings.ToLower(strings.TrimSpace(category))] = notifierFor(url)
+	}
+	if config.Default != "" {
+		router.fallback = notifierFor(config.Default)
+	}
+	return router, nil
+}
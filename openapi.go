@@ -0,0 +1,129 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"time"
+)
+
+// openAPISpec returns the OpenAPI 3 spec of the routes, with the response schemas derived from their Go types
+func openAPISpec(routes []route) map[string]interface{} {
+	schemas := make(map[string]interface{})
+	paths := make(map[string]map[string]interface{})
+
+	for _, r := range routes {
+		content := map[string]interface{}{"schema": map[string]interface{}{"type": "object"}}
+		if r.response != nil {
+			content["schema"] = schemaOf(reflect.TypeOf(r.response), schemas)
+		}
+
+		var params []interface{}
+		for _, p := range r.params {
+			params = append(params, map[string]interface{}{
+				"name":        p.name,
+				"in":          p.in,
+				"description": p.description,
+				"required":    p.required,
+				"schema":      map[string]interface{}{"type": "string"},
+			})
+		}
+
+		contentType := "application/json"
+		if r.contentType != "" {
+			contentType = r.contentType
+		}
+		responses := map[string]interface{}{
+			"200": map[string]interface{}{
+				"description": "OK",
+				"content":     map[string]interface{}{contentType: content},
+			},
+		}
+		operation := map[string]interface{}{
+			"summary":   r.summary,
+			"responses": responses,
+		}
+		if !r.public {
+			operation["security"] = []interface{}{map[string]interface{}{"bearer": []interface{}{}}}
+			responses["401"] = map[string]interface{}{"description": "Missing or wrong token"}
+		}
+		if len(params) > 0 {
+			operation["parameters"] = params
+		}
+
+		if paths[r.path] == nil {
+			paths[r.path] = make(map[string]interface{})
+		}
+		paths[r.path][strings.ToLower(r.method)] = operation
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "Spaggiari circulars parser",
+			"version": version,
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"bearer": map[string]interface{}{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+}
+
+// schemaOf returns the JSON schema of t, as encoded by encoding/json.
+// Named structs are added to schemas and referenced
+func schemaOf(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	switch t.Kind() {
+	case reflect.Ptr:
+		s := schemaOf(t.Elem(), schemas)
+		if _, isRef := s["$ref"]; isRef {
+			return map[string]interface{}{"allOf": []interface{}{s}, "nullable": true}
+		}
+		s["nullable"] = true
+		return s
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": schemaOf(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaOf(t.Elem(), schemas)}
+	case reflect.Struct:
+		if t == reflect.TypeOf(time.Time{}) {
+			return map[string]interface{}{"type": "string", "format": "date-time"}
+		}
+		ref := map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+		if _, exists := schemas[t.Name()]; exists {
+			return ref
+		}
+		// Reserve the name first, so recursive types end
+		schemas[t.Name()] = nil
+
+		properties := make(map[string]interface{})
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			name := f.Name
+			if tag := strings.Split(f.Tag.Get("json"), ",")[0]; tag == "-" {
+				continue
+			} else if tag != "" {
+				name = tag
+			}
+			properties[name] = schemaOf(f.Type, schemas)
+		}
+		schemas[t.Name()] = map[string]interface{}{"type": "object", "properties": properties}
+		return ref
+	}
+	return map[string]interface{}{}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// parseSavedResponse returns the circulars parsed from filename.
+// The file is either a saved html page or a JSON response of the search endpoint, as saved by CIRCULARS_DEBUG_CAPTURE_DIR.
+// The fragment of a JSON response is wrapped only when it doesn't have a table, as with CIRCULARS_TABLE_WRAP=auto
+func parseSavedResponse(filename string, opts parseOptions) ([]circular, error) {
+	body, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	pageHtml := string(decodeCharset("", body))
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '{' {
+		var m moreCircularsMsg
+		if err := json.Unmarshal(trimmed, &m); err != nil {
+			return nil, errors.New("can't parse the JSON response")
+		}
+		pageHtml = "<html><body>" + wrapFragment(m.Htm, tableWrapAuto) + "</body></html>"
+	}
+	circulars, _, err := parseCirculars(strings.NewReader(pageHtml), opts)
+	return circulars, err
+}
+
+// parseFile writes to w as JSON the circulars parsed from filename, with the parsing options of the env variables
+func parseFile(filename string, opts parseOptions, w io.Writer) error {
+	circulars, err := parseSavedResponse(filename, opts)
+	if err != nil {
+		return err
+	}
+	if circulars == nil {
+		circulars = []circular{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(circulars)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// maxMimeTypeLen is the size of the mime type column
+const maxMimeTypeLen = 255
+
+// type attachmentProber gets the type and size of the stored attachments without downloading them,
+// with a HEAD request or, when the server doesn't support it, a GET of the first byte
+type attachmentProber struct {
+	client *http.Client
+	// sem bounds the parallel requests, it's shared by the schools processed in parallel
+	sem chan struct{}
+}
+
+// newAttachmentProber returns a prober running at most concurrency requests in parallel
+func newAttachmentProber(client *http.Client, concurrency int) *attachmentProber {
+	return &attachmentProber{client: client, sem: make(chan struct{}, concurrency)}
+}
+
+// type probedAttachment is the type and size of an attachment, mimeType is empty and size is 0 when the server doesn't tell
+type probedAttachment struct {
+	mimeType string
+	size     uint64
+}
+
+// unprobedAttachments returns which of the attachments are stored without a mime type
+func unprobedAttachments(ctx context.Context, db *sql.DB, ids []uint64) ([]uint64, error) {
+	col := columns
+	var unprobed []uint64
+	for len(ids) > 0 {
+		n := len(ids)
+		if n > maxStatementIds {
+			n = maxStatementIds
+		}
+		chunk := ids[:n]
+		ids = ids[n:]
+
+		args := make([]interface{}, len(chunk))
+		for i, id := range chunk {
+			args[i] = id
+		}
+		rows, err := db.QueryContext(ctx,
+			"SELECT `"+col.attachmentId+"` FROM circolare_allegato WHERE `"+col.attachmentMimeType+"` IS NULL AND `"+col.attachmentId+"` IN (?"+strings.Repeat(", ?", len(chunk)-1)+")",
+			args...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var id uint64
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			unprobed = append(unprobed, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return unprobed, nil
+}
+
+// probe returns the type and size of the attachment. A HEAD refused with 405 or 501 is retried as a GET of the first byte
+func (p *attachmentProber) probe(ctx context.Context, siteUrl string, id uint64) (probedAttachment, error) {
+	u, err := attachmentUrl(siteUrl, id)
+	if err != nil {
+		return probedAttachment{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, u, nil)
+	if err != nil {
+		return probedAttachment{}, err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return probedAttachment{}, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented {
+		if req, err = http.NewRequestWithContext(ctx, http.MethodGet, u, nil); err != nil {
+			return probedAttachment{}, err
+		}
+		req.Header.Set("Range", "bytes=0-0")
+		if resp, err = p.client.Do(req); err != nil {
+			return probedAttachment{}, err
+		}
+		// Only the headers are needed, the body isn't drained
+		resp.Body.Close()
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return probedAttachment{}, fmt.Errorf("attachment %d: status %s", id, resp.Status)
+	}
+
+	var res probedAttachment
+	res.mimeType = resp.Header.Get("Content-Type")
+	if mediaType, _, err := mime.ParseMediaType(res.mimeType); err == nil {
+		res.mimeType = mediaType
+	}
+	res.mimeType, _ = truncate(res.mimeType, maxMimeTypeLen)
+	// A ranged response has the whole size after the slash of Content-Range, e.g. "bytes 0-0/12345"
+	if resp.StatusCode == http.StatusPartialContent {
+		if i := strings.LastIndex(resp.Header.Get("Content-Range"), "/"); i >= 0 {
+			res.size, _ = strconv.ParseUint(resp.Header.Get("Content-Range")[i+1:], 10, 64)
+		}
+	} else if resp.ContentLength > 0 {
+		res.size = uint64(resp.ContentLength)
+	}
+	return res, nil
+}
+
+// probeAll stores the type of the attachments of the circulars that don't have one yet, and their size when it isn't known.
+// The requests run in parallel, a failed one doesn't stop the others. Once ctx is done no other request starts.
+// A missing Content-Type is stored as NULL, so the attachment is probed again by the next cycles.
+// Returns how many were probed and how many failed
+func (p *attachmentProber) probeAll(ctx context.Context, db *sql.DB, siteUrl string, circulars []circular) (probed, failed int, err error) {
+	var ids []uint64
+	for _, c := range circulars {
+		for _, att := range c.Attachments {
+			ids = append(ids, att.Id)
+		}
+	}
+	unprobed, err := unprobedAttachments(ctx, db, ids)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	col := columns
+	query := "UPDATE circolare_allegato SET `" + col.attachmentMimeType + "` = ?, `" + col.attachmentSize + "` = COALESCE(`" + col.attachmentSize + "`, ?) WHERE `" + col.attachmentId + "` = ?"
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+jobs:
+	for _, id := range unprobed {
+		select {
+		case p.sem <- struct{}{}:
+		case <-ctx.Done():
+			break jobs
+		}
+		wg.Add(1)
+		go func(id uint64) {
+			defer wg.Done()
+			defer func() { <-p.sem }()
+			// The slot could be taken right when ctx is done
+			if ctx.Err() != nil {
+				return
+			}
+			err := func() (err error) {
+				defer recoverPanic("probe", &err)
+				res, err := p.probe(ctx, siteUrl, id)
+				if err != nil {
+					return err
+				}
+				_, err = db.ExecContext(ctx, query, nullableString(res.mimeType), nullableSize(res.size), id)
+				return err
+			}()
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				log.Printf("ERROR: can't probe attachment %d: %v", id, err)
+				failed++
+				return
+			}
+			probed++
+		}(id)
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		log.Printf("WARNING: attachment probes stopped: %v", err)
+	}
+	return probed, failed, nil
+}
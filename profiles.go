@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+// type profilesConfig is the file format of CIRCULARS_PROFILES_FILE, the CIRCULARS_ variables of each named profile. e.g.
+// {"staging": {"CIRCULARS_SITE_URL": "https://...", "CIRCULARS_DB_CONNECTION_STRING": "..."}, "prod": {...}}
+type profilesConfig map[string]map[string]string
+
+// loadProfile reads the profiles file and returns the variables of the named profile.
+// Returns an error listing the defined profiles when it doesn't exist
+func loadProfile(filename, name string) (map[string]string, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var profiles profilesConfig
+	if err := json.Unmarshal(content, &profiles); err != nil {
+		return nil, err
+	}
+
+	profile, exists := profiles[name]
+	if !exists {
+		names := make([]string, 0, len(profiles))
+		for n := range profiles {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("profile %q isn't defined, the defined ones are %v", name, names)
+	}
+	for key := range profile {
+		// The profiles can't change the selection itself
+		if !strings.HasPrefix(key, "CIRCULARS_") || key == "CIRCULARS_PROFILE" || key == "CIRCULARS_PROFILES_FILE" {
+			return nil, fmt.Errorf("profile %q: %s isn't a configuration variable", name, key)
+		}
+	}
+	return profile, nil
+}
+
+// applyProfile sets the variables of the profile that aren't already in the environment, so the environment overrides the profile.
+// Returns how many were set
+func applyProfile(profile map[string]string) (int, error) {
+	set := 0
+	for key, value := range profile {
+		if _, exists := os.LookupEnv(key); exists {
+			continue
+		}
+		if err := os.Setenv(key, value); err != nil {
+			return set, err
+		}
+		set++
+	}
+	return set, nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// type writeAheadQueue keeps on disk the parsed circulars whose insert failed, so a DB outage doesn't lose a cycle.
+// Each batch is a JSON file in dir, named so they sort oldest first. The batches are drained at the start of each cycle
+type writeAheadQueue struct {
+	dir string
+	// maxBatches is how many batches are kept, the oldest are dropped
+	maxBatches int
+}
+
+// type queuedBatch is the file format of a batch of writeAheadQueue
+type queuedBatch struct {
+	SiteUrl   string     `json:"site_url"`
+	QueuedAt  time.Time  `json:"queued_at"`
+	Circulars []circular `json:"circulars"`
+}
+
+// batches returns the paths of the queued batches, oldest first
+func (q *writeAheadQueue) batches() ([]string, error) {
+	entries, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".json") {
+			paths = append(paths, filepath.Join(q.dir, e.Name()))
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// push queues the circulars parsed from siteUrl. The file is written with a temporary name first,
+// so a partial write is never drained. The oldest batches past maxBatches are dropped
+func (q *writeAheadQueue) push(siteUrl string, circulars []circular) error {
+	if err := os.MkdirAll(q.dir, 0755); err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	content, err := json.Marshal(queuedBatch{SiteUrl: siteUrl, QueuedAt: now, Circulars: circulars})
+	if err != nil {
+		return err
+	}
+	school := "unknown"
+	if i := strings.Index(siteUrl, "sede_codice="); i >= 0 {
+		school = sanitizeFileName(siteUrl[i+len("sede_codice="):])
+	}
+	p := filepath.Join(q.dir, fmt.Sprintf("%s_%s.json", now.Format("20060102T150405.000000000"), school))
+	if err := ioutil.WriteFile(p+".part", content, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(p+".part", p); err != nil {
+		return err
+	}
+
+	paths, err := q.batches()
+	if err != nil {
+		return err
+	}
+	for len(paths) > q.maxBatches {
+		log.Printf("WARNING: the queue is full, dropping the batch %s", filepath.Base(paths[0]))
+		if err := os.Remove(paths[0]); err != nil {
+			return err
+		}
+		paths = paths[1:]
+	}
+	return nil
+}
+
+// drainQueue inserts the queued batches in order, removing each once committed.
+// It stops at the first failure, the remaining batches are retried by the next cycle
+func (w *worker) drainQueue(ctx context.Context) {
+	paths, err := w.queue.batches()
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("ERROR: can't read the queue: %v", err)
+		}
+		return
+	}
+	for _, p := range paths {
+		content, err := ioutil.ReadFile(p)
+		if err != nil {
+			log.Printf("ERROR: can't read the queued batch %s: %v", filepath.Base(p), err)
+			return
+		}
+		var b queuedBatch
+		if err := json.Unmarshal(content, &b); err != nil {
+			// A broken batch would block the queue forever
+			log.Printf("ERROR: dropping the queued batch %s, it can't be decoded: %v", filepath.Base(p), err)
+			os.Remove(p)
+			continue
+		}
+
+		newCirculars, updated, err := insertCirculars(ctx, w.db, b.Circulars, w.shouldUpdate)
+		if err != nil {
+			log.Printf("ERROR: can't insert the queued batch %s, queued at %s: %v", filepath.Base(p), b.QueuedAt.Format(time.RFC3339), err)
+			return
+		}
+		if err := os.Remove(p); err != nil {
+			log.Printf("ERROR: can't remove the inserted batch %s: %v", filepath.Base(p), err)
+			return
+		}
+		log.Printf("INFO: inserted the queued batch of %s, %d new and %d updated circulars", b.SiteUrl, len(newCirculars), updated)
+		if w.notifier != nil && len(newCirculars) > 0 {
+			if err := w.notifier.notify(ctx, newCirculars); err != nil {
+				log.Printf("ERROR: %v", err)
+			}
+		}
+	}
+}
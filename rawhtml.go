@@ -0,0 +1,34 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+)
+
+// compressHtml returns the gzipped html, as stored in circolare_html
+func compressHtml(html string) ([]byte, error) {
+	var buf bytes.Buffer
+	gz, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := gz.Write([]byte(html)); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// purgeOrphanRawHtml deletes the html of the circulars that aren't stored anymore, returning how many were deleted
+func purgeOrphanRawHtml(ctx context.Context, db *sql.DB) (int64, error) {
+	res, err := db.ExecContext(ctx,
+		"DELETE h FROM circolare_html h LEFT JOIN circolare c ON c.`"+columns.id+"` = h.id_circolare WHERE c.`"+columns.id+"` IS NULL")
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"sync"
+)
+
+// errRefreshPanicked is returned to the callers sharing a refresh whose cycle panicked
+var errRefreshPanicked = errors.New("refresh cycle panicked")
+
+// type refreshFlight lets the concurrent /refresh requests share a single cycle,
+// the requests arriving while it runs get its result instead of starting another one
+type refreshFlight struct {
+	mu   sync.Mutex
+	call *refreshCall
+}
+
+// type refreshCall is the cycle in flight, res and err are set before done is closed
+type refreshCall struct {
+	done chan struct{}
+	res  cycleResult
+	err  error
+}
+
+// do runs fn unless a call is already in flight, in which case it waits for it. shared is true for the waiting callers
+func (f *refreshFlight) do(fn func() (cycleResult, error)) (res cycleResult, shared bool, err error) {
+	f.mu.Lock()
+	if c := f.call; c != nil {
+		f.mu.Unlock()
+		<-c.done
+		return c.res, true, c.err
+	}
+	c := &refreshCall{done: make(chan struct{})}
+	f.call = c
+	f.mu.Unlock()
+
+	// The call is released even if fn panics, the waiting callers get an error instead of hanging
+	defer func() {
+		f.mu.Lock()
+		f.call = nil
+		f.mu.Unlock()
+		close(c.done)
+	}()
+	c.err = errRefreshPanicked
+	c.res, c.err = fn()
+	return c.res, false, c.err
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRefreshFlightShared(t *testing.T) {
+	var f refreshFlight
+	var cycles int32
+	started, release := make(chan struct{}), make(chan struct{})
+	cycle := func() (cycleResult, error) {
+		if atomic.AddInt32(&cycles, 1) == 1 {
+			close(started)
+		}
+		<-release
+		return cycleResult{Parsed: 42}, nil
+	}
+
+	const callers = 5
+	var wg sync.WaitGroup
+	results := make([]cycleResult, callers)
+	shared := make([]bool, callers)
+	errs := make([]error, callers)
+	call := func(i int) {
+		defer wg.Done()
+		results[i], shared[i], errs[i] = f.do(cycle)
+	}
+
+	wg.Add(callers)
+	go call(0)
+	<-started
+	for i := 1; i < callers; i++ {
+		go call(i)
+	}
+	// The callers must be waiting on the cycle in flight before it ends
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if cycles != 1 {
+		t.Errorf("ran %d cycles, expected 1", cycles)
+	}
+	for i := 0; i < callers; i++ {
+		if errs[i] != nil || results[i].Parsed != 42 || shared[i] != (i > 0) {
+			t.Errorf("caller %d got %+v, shared %t, %v", i, results[i], shared[i], errs[i])
+		}
+	}
+
+	// The next call runs its own cycle
+	if _, shared, _ := f.do(cycle); shared || cycles != 2 {
+		t.Errorf("the call after the flight is shared %t, ran %d cycles", shared, cycles)
+	}
+}
+
+func TestRefreshFlightPanic(t *testing.T) {
+	var f refreshFlight
+	started, release := make(chan struct{}), make(chan struct{})
+	waiter := make(chan error)
+	go func() {
+		defer func() { recover() }()
+		f.do(func() (cycleResult, error) {
+			close(started)
+			<-release
+			panic("cycle")
+		})
+	}()
+	<-started
+	go func() {
+		_, _, err := f.do(func() (cycleResult, error) { return cycleResult{}, nil })
+		waiter <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	if err := <-waiter; err != errRefreshPanicked {
+		t.Errorf("the waiting caller got %v, expected %v", err, errRefreshPanicked)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// maxRejectedReasonLen is the size of circolare_scartata.motivo
+const maxRejectedReasonLen = 255
+
+// storeRejected records in circolare_scartata the circulars of the school skipped while parsing.
+// A circular skipped again keeps when it was first skipped, ultima_il and the reason are updated.
+// The rows whose id couldn't be parsed are all recorded with id 0
+func storeRejected(ctx context.Context, db *sql.DB, siteUrl string, parseErrors []parseError) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	for _, e := range parseErrors {
+		reason, _ := truncate(e.Reason, maxRejectedReasonLen)
+		_, err := tx.ExecContext(ctx,
+			"INSERT INTO circolare_scartata (id_circolare, url_sito, campo, motivo, scartata_il, ultima_il) VALUES (?, ?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE "+
+				updateColumns("motivo", "ultima_il"),
+			e.Id, siteUrl, e.Field, reason, now, now)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
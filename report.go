@@ -0,0 +1,95 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+)
+
+// unknownMonth is the month of the circulars without a published date
+const unknownMonth = "unknown"
+
+// type report is the publishing volume printed by -report
+type report struct {
+	Total      int            `json:"total"`
+	Categories map[string]int `json:"categories"`
+	// Months are yyyy-mm
+	Months map[string]int `json:"months"`
+	// ByMonth are the counts of each category in each month, the oldest month first
+	ByMonth []reportRow `json:"by_month"`
+}
+
+// type reportRow is the number of circulars of a category published in a month
+type reportRow struct {
+	Month    string `json:"month"`
+	Category string `json:"category"`
+	Count    int    `json:"count"`
+}
+
+// queryReport counts the stored circulars per category and per month, without the ones hidden by an operator
+func queryReport(db *sql.DB) (*report, error) {
+	r := &report{Categories: make(map[string]int), Months: make(map[string]int), ByMonth: []reportRow{}}
+
+	category := "`" + columns.category + "`"
+	rows, err := db.Query("SELECT DATE_FORMAT(`" + columns.publishedDate + "`, '%Y-%m') month, " + category + ", COUNT(*) " +
+		"FROM circolare WHERE `" + columns.deletedAt + "` IS NULL GROUP BY month, " + category + " ORDER BY month IS NULL, month, " + category)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var month sql.NullString
+		var row reportRow
+		if err := rows.Scan(&month, &row.Category, &row.Count); err != nil {
+			return nil, err
+		}
+		row.Month = unknownMonth
+		if month.Valid {
+			row.Month = month.String
+		}
+		r.ByMonth = append(r.ByMonth, row)
+		r.Total += row.Count
+		r.Categories[row.Category] += row.Count
+		r.Months[row.Month] += row.Count
+	}
+	return r, rows.Err()
+}
+
+// write prints the report as JSON, or as human readable tables when format is text
+func (r *report) write(w io.Writer, format string) error {
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "CATEGORY\tCIRCULARS\n")
+	categories := make([]string, 0, len(r.Categories))
+	for c := range r.Categories {
+		categories = append(categories, c)
+	}
+	// The busiest categories first
+	sort.Slice(categories, func(i, j int) bool {
+		if r.Categories[categories[i]] != r.Categories[categories[j]] {
+			return r.Categories[categories[i]] > r.Categories[categories[j]]
+		}
+		return categories[i] < categories[j]
+	})
+	for _, c := range categories {
+		fmt.Fprintf(tw, "%s\t%d\n", c, r.Categories[c])
+	}
+	fmt.Fprintf(tw, "TOTAL\t%d\n\n", r.Total)
+
+	fmt.Fprintf(tw, "MONTH\tCIRCULARS\n")
+	// ByMonth is sorted by month, with the unknown one last
+	for i, row := range r.ByMonth {
+		if i == 0 || r.ByMonth[i-1].Month != row.Month {
+			fmt.Fprintf(tw, "%s\t%d\n", row.Month, r.Months[row.Month])
+		}
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// captureSchool returns the sede_codice in the name of a response saved by captureResponse, empty when it's unknown
+func captureSchool(name string) string {
+	parts := strings.Split(name, "_")
+	if len(parts) < 3 || parts[1] == "unknown" {
+		return ""
+	}
+	return parts[1]
+}
+
+// type storedSummary is what reprocess compares of a stored circular
+type storedSummary struct {
+	title, category, publishedDate string
+}
+
+// queryStoredSummaries returns the stored circulars among ids
+func queryStoredSummaries(db *sql.DB, ids []uint64) (map[uint64]storedSummary, error) {
+	col := columns
+	stored := make(map[uint64]storedSummary)
+	for len(ids) > 0 {
+		n := len(ids)
+		if n > maxStatementIds {
+			n = maxStatementIds
+		}
+		chunk := ids[:n]
+		ids = ids[n:]
+
+		args := make([]interface{}, len(chunk))
+		for i, id := range chunk {
+			args[i] = id
+		}
+		rows, err := db.Query(
+			"SELECT `"+col.id+"`, `"+col.title+"`, `"+col.category+"`, `"+col.publishedDate+"` FROM circolare WHERE `"+col.id+"` IN (?"+strings.Repeat(", ?", len(chunk)-1)+")",
+			args...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var id uint64
+			var s storedSummary
+			var published sql.NullString
+			if err := rows.Scan(&id, &s.title, &s.category, &published); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			s.publishedDate = published.String
+			stored[id] = s
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return stored, nil
+}
+
+// reprocess parses again every response saved in dir with the current parser, logging the circulars missing from the DB
+// and the ones stored with different values. With write, the missing circulars are inserted, the stored ones are left as they are,
+// since the saved responses can be older than the DB. siteUrls are used to rebuild the urls of the circulars
+func reprocess(db *sql.DB, dir string, siteUrls []string, opts parseOptions, transformers []transformer, write bool) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	schools := make(map[string]string)
+	for _, siteUrl := range siteUrls {
+		if u, err := url.Parse(siteUrl); err == nil {
+			schools[sanitizeFileName(u.Query().Get("sede_codice"))] = siteUrl
+		}
+	}
+
+	// The names start with the capture time, so a circular saved more times keeps its latest version
+	sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+	parsed := make(map[uint64]circular)
+	parsedFiles := 0
+	for _, f := range files {
+		if f.IsDir() || (filepath.Ext(f.Name()) != ".html" && filepath.Ext(f.Name()) != ".json") {
+			continue
+		}
+		circulars, err := parseSavedResponse(filepath.Join(dir, f.Name()), opts)
+		if errors.Is(err, errNoCircularRows) {
+			continue
+		}
+		if err != nil {
+			log.Printf("WARNING: can't parse %s: %v. Skipping", f.Name(), err)
+			continue
+		}
+		parsedFiles++
+		siteUrl := schools[captureSchool(f.Name())]
+		for _, c := range circulars {
+			if siteUrl != "" {
+				c.Url, _ = circularUrl(siteUrl, c.Id)
+			}
+			parsed[c.Id] = c
+		}
+	}
+
+	var circulars []circular
+	for _, c := range parsed {
+		circulars = append(circulars, c)
+	}
+	circulars = applyTransformers(circulars, transformers)
+	// The most recent first, as the website lists them
+	sort.Slice(circulars, func(i, j int) bool { return circulars[i].Id > circulars[j].Id })
+	log.Printf("INFO: parsed %d circulars from %d saved responses", len(circulars), parsedFiles)
+
+	ids := make([]uint64, len(circulars))
+	for i, c := range circulars {
+		ids[i] = c.Id
+	}
+	stored, err := queryStoredSummaries(db, ids)
+	if err != nil {
+		return err
+	}
+
+	var missing []circular
+	changed := 0
+	for _, c := range circulars {
+		s, exists := stored[c.Id]
+		if !exists {
+			log.Printf("INFO: circular %d %q is missing from the DB", c.Id, c.Title)
+			missing = append(missing, c)
+			continue
+		}
+		published := ""
+		if !c.PublishedDate.IsZero() {
+			published = c.PublishedDate.Format("2006-01-02")
+		}
+		if s.title != c.Title || s.category != c.Category || s.publishedDate != published {
+			log.Printf("INFO: circular %d differs, stored %q/%q/%s, parsed %q/%q/%s", c.Id, s.title, s.category, s.publishedDate, c.Title, c.Category, published)
+			changed++
+		}
+	}
+	log.Printf("INFO: %d circulars missing from the DB, %d stored with different values", len(missing), changed)
+
+	if !write || len(missing) == 0 {
+		return nil
+	}
+	inserted, _, err := insertCirculars(context.Background(), db, missing, func(int, circular) bool { return false })
+	if err != nil {
+		return err
+	}
+	log.Printf("INFO: inserted %d missing circulars", len(inserted))
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"strings"
+	"unicode"
+)
+
+// fulltextIndex is the name of the FULLTEXT index on the titles
+const fulltextIndex = "ft_titolo"
+
+// defaultSearchLimit is the max number of results returned by a search
+const defaultSearchLimit = 50
+
+// type searchResult is a circular matching a search
+type searchResult struct {
+	Id       uint64 `json:"id"`
+	Title    string `json:"title"`
+	Category string `json:"category"`
+	// PublishedDate is yyyy-mm-dd, empty when unknown
+	PublishedDate string `json:"published_date"`
+	Url           string `json:"url"`
+}
+
+// ensureFulltextIndex creates the FULLTEXT index on the titles when it's missing.
+// Returns the min length of the indexed words, shorter ones are never matched by MATCH ... AGAINST
+func ensureFulltextIndex(db *sql.DB) (minTokenSize int, err error) {
+	var count int
+	if err := db.QueryRow(
+		"SELECT COUNT(*) FROM information_schema.STATISTICS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'circolare' AND INDEX_NAME = ?",
+		fulltextIndex).Scan(&count); err != nil {
+		return 0, err
+	}
+	if count == 0 {
+		log.Printf("INFO: creating the FULLTEXT index %s, it could take a while", fulltextIndex)
+		if _, err := db.Exec("ALTER TABLE circolare ADD FULLTEXT INDEX " + fulltextIndex + " (`" + columns.title + "`)"); err != nil {
+			return 0, err
+		}
+	}
+
+	// InnoDB default, used when the variable can't be read
+	minTokenSize = 3
+	if err := db.QueryRow("SELECT @@innodb_ft_min_token_size").Scan(&minTokenSize); err != nil {
+		log.Printf("WARNING: can't read innodb_ft_min_token_size, assuming %d: %v", minTokenSize, err)
+	}
+	return minTokenSize, nil
+}
+
+// searchWords splits the query into words, dropping the fulltext boolean operators and any other punctuation
+func searchWords(q string) []string {
+	return strings.FieldsFunc(q, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) })
+}
+
+// searchCirculars returns the circulars whose title contains all the words of q, the most relevant first.
+// With minTokenSize > 0 the FULLTEXT index is used, only with the words long enough to be indexed.
+// Any word could be a stopword, so when the index finds nothing, or no word can be looked up in it, the titles are scanned with LIKE
+func searchCirculars(db *sql.DB, q string, minTokenSize, limit int) ([]searchResult, error) {
+	words := searchWords(q)
+	if len(words) == 0 {
+		return []searchResult{}, nil
+	}
+	col := columns
+	title := "`" + col.title + "`"
+	selectResults := "SELECT `" + col.id + "` id, " + title + ", `" + col.category + "`, `" + col.publishedDate + "`, `" + col.url + "` FROM circolare WHERE `" + col.deletedAt + "` IS NULL AND "
+
+	if minTokenSize > 0 {
+		var terms []string
+		for _, w := range words {
+			if len([]rune(w)) >= minTokenSize {
+				terms = append(terms, "+"+w+"*")
+			}
+		}
+		if len(terms) > 0 {
+			against := strings.Join(terms, " ")
+			results, err := querySearch(db,
+				selectResults+"MATCH("+title+") AGAINST(? IN BOOLEAN MODE) ORDER BY MATCH("+title+") AGAINST(? IN BOOLEAN MODE) DESC, id DESC LIMIT ?",
+				against, against, limit)
+			if err != nil || len(results) > 0 {
+				return results, err
+			}
+		}
+	}
+
+	var conds []string
+	var args []interface{}
+	escaper := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+	for _, w := range words {
+		conds = append(conds, title+" LIKE ?")
+		args = append(args, "%"+escaper.Replace(w)+"%")
+	}
+	args = append(args, limit)
+	return querySearch(db, selectResults+strings.Join(conds, " AND ")+" ORDER BY id DESC LIMIT ?", args...)
+}
+
+// querySearch executes a search query, selecting id, title, category, date and url
+func querySearch(db *sql.DB, query string, args ...interface{}) ([]searchResult, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []searchResult{}
+	for rows.Next() {
+		var r searchResult
+		var published, u sql.NullString
+		if err := rows.Scan(&r.Id, &r.Title, &r.Category, &published, &u); err != nil {
+			return nil, err
+		}
+		r.PublishedDate, r.Url = published.String, u.String
+		results = append(results, r)
+	}
+	return results, rows.Err()
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"strings"
+)
+
+// selftestFixture is a known good response, with a row that must be skipped.
+// It's also the fixture of the parsing tests, which check each parsed field
+//
+//go:embed fixtures/selftest.html
+var selftestFixture string
+
+// selftestExpected is the number of circulars that must be parsed from selftestFixture
+const selftestExpected = 5
+
+// runSelftest parses the bundled fixture and checks the number of parsed circulars and the migrations, without network nor DB
+func runSelftest() error {
+	circulars, parseErrors, err := parseCirculars(strings.NewReader(selftestFixture), parseOptions{locale: locales[defaultLocale], mergeDuplicateAttachments: true, schoolYearStartMonth: defaultSchoolYearStartMonth})
+	if err != nil {
+		return err
+	}
+
+	for _, c := range circulars {
+		fmt.Printf("%d\t%s\t%s\t%s\t%d attachments\n", c.Id, c.PublishedDate.Format("2006-01-02"), c.Category, c.Title, len(c.Attachments))
+	}
+	if len(circulars) != selftestExpected {
+		return fmt.Errorf("parsed %d circulars, expected %d", len(circulars), selftestExpected)
+	}
+	if len(parseErrors) != 1 {
+		return fmt.Errorf("got parse errors %v, expected only the skipped row", parseErrors)
+	}
+
+	// The migrations must load and have every placeholder replaced
+	migrations, err := loadMigrations(dbDriver, defaultColumns())
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		for _, statement := range m.statements {
+			if strings.Contains(statement, "{") {
+				return fmt.Errorf("migration %s has an unknown placeholder", m.name)
+			}
+		}
+	}
+	fmt.Printf("OK: %d migrations\n", len(migrations))
+	fmt.Printf("OK: parsed %d circulars\n", len(circulars))
+	return nil
+}
@@ -0,0 +1,495 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"encoding/xml"
+	"expvar"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// type route describes an endpoint, it's used both for registering its handler and for documenting it in /openapi.json
+type route struct {
+	method string
+	path   string
+	// pattern is registered on the mux instead of path, for paths with parameters
+	pattern string
+	summary string
+	params  []routeParam
+	// response is a value of the type of the JSON response, nil when its shape isn't fixed
+	response interface{}
+	// contentType of the response, JSON when empty
+	contentType string
+	handler     http.HandlerFunc
+	// public routes don't require the token
+	public bool
+	// admin routes require the admin token instead of the token
+	admin bool
+}
+
+// type routeParam describes a parameter of an endpoint
+type routeParam struct {
+	name        string
+	in          string
+	description string
+	required    bool
+}
+
+// routes returns the endpoints exposed by the HTTP server
+func (w *worker) routes() []route {
+	routes := []route{
+		{
+			method:   http.MethodPost,
+			path:     "/refresh",
+			summary:  "Execute an immediate cycle without cleanup",
+			response: cycleResult{},
+			handler:  w.handleRefresh,
+		},
+		{
+			method:   http.MethodGet,
+			path:     "/stats",
+			summary:  "Aggregates of the stored circulars",
+			response: dbStats{},
+			handler:  w.handleStats,
+		},
+		{
+			method:  http.MethodGet,
+			path:    "/search",
+			summary: "Circulars whose title contains all the words of the query, the most relevant first",
+			params: []routeParam{
+				{name: "q", in: "query", description: "words to search", required: true},
+				{name: "limit", in: "query", description: "max number of results, 50 by default"},
+			},
+			response: []searchResult{},
+			handler:  w.handleSearch,
+		},
+		{
+			method:  http.MethodGet,
+			path:    "/circulars/changes",
+			summary: "Circulars added, changed or hidden after a time, the oldest changes first",
+			params: []routeParam{
+				{name: "since", in: "query", description: "RFC3339 time, e.g. the changed_at of the last received change", required: true},
+				{name: "after_id", in: "query", description: "id of the last received change, the changes at since with a greater id are returned. 0 by default"},
+				{name: "limit", in: "query", description: "max number of results, 500 by default"},
+			},
+			response: []circularChange{},
+			handler:  w.handleChanges,
+		},
+		{
+			method:  http.MethodGet,
+			path:    "/circulars",
+			summary: "Most recent circulars, served from the cache of the last cycle when possible",
+			params: []routeParam{
+				{name: "limit", in: "query", description: "max number of results, 50 by default"},
+			},
+			response: []latestCircular{},
+			handler:  w.handleLatest,
+		},
+		{
+			method:  http.MethodGet,
+			path:    "/circulars/active",
+			summary: "Most recent circulars still valid today, see CIRCULARS_VALID_UNTIL for the last valid day",
+			params: []routeParam{
+				{name: "limit", in: "query", description: "max number of results, 50 by default"},
+			},
+			response: []latestCircular{},
+			handler:  w.handleActive,
+		},
+		{
+			method:  http.MethodGet,
+			path:    "/feed",
+			summary: "RSS feed of the most recent circulars",
+			params: []routeParam{
+				{name: "limit", in: "query", description: "max number of items, 50 by default"},
+			},
+			contentType: "application/rss+xml",
+			handler:     w.handleFeed,
+		},
+		{
+			method:  http.MethodGet,
+			path:    "/calendar.ics",
+			summary: "iCalendar feed of the most recent circulars, an all day event from the published date through the valid until one",
+			params: []routeParam{
+				{name: "limit", in: "query", description: "max number of events, 50 by default"},
+			},
+			contentType: "text/calendar",
+			handler:     w.handleCalendar,
+		},
+		{
+			method:   http.MethodGet,
+			path:     "/health",
+			summary:  "Health of the worker and state of the fetch circuit breaker of each school",
+			response: health{},
+			handler:  w.handleHealth,
+			public:   true,
+		},
+		{
+			method:  http.MethodGet,
+			path:    "/debug/vars",
+			summary: "Metrics published with expvar",
+			handler: expvar.Handler().ServeHTTP,
+		},
+	}
+	if w.adminEndpoints {
+		routes = append(routes, route{
+			method:  http.MethodPost,
+			path:    "/circulars/{id}/{action}",
+			pattern: "/circulars/",
+			summary: "Hide a circular from the other endpoints with the delete action, or show it again with restore. Requires the admin token",
+			params: []routeParam{
+				{name: "id", in: "path", description: "id of the circular", required: true},
+				{name: "action", in: "path", description: "delete or restore", required: true},
+			},
+			response: adminResult{},
+			handler:  w.handleAdmin,
+			admin:    true,
+		})
+	}
+	if w.proxyAttachments {
+		routes = append(routes, route{
+			method:  http.MethodGet,
+			path:    "/attachments/{id}",
+			pattern: "/attachments/",
+			summary: "File of a stored attachment, streamed from the segreteria digitale",
+			params: []routeParam{
+				{name: "id", in: "path", description: "id of the attachment", required: true},
+			},
+			contentType: "application/octet-stream",
+			handler:     w.handleAttachment,
+		})
+	}
+	return routes
+}
+
+// serveHTTP starts the HTTP server exposing the worker endpoints.
+// Every endpoint, except the public ones and /openapi.json, requires the 'Authorization: Bearer <token>' header
+func serveHTTP(addr, token, adminToken string, w *worker) {
+	routes := w.routes()
+
+	mux := http.NewServeMux()
+	for _, r := range routes {
+		handler := allowMethod(r.method, r.handler)
+		if r.admin {
+			handler = requireToken(adminToken, handler)
+		} else if !r.public {
+			handler = requireToken(token, handler)
+		}
+		pattern := r.path
+		if r.pattern != "" {
+			pattern = r.pattern
+		}
+		mux.HandleFunc(pattern, handler)
+	}
+	spec := openAPISpec(routes)
+	mux.HandleFunc("/openapi.json", allowMethod(http.MethodGet, func(rw http.ResponseWriter, r *http.Request) {
+		writeJSON(rw, spec)
+	}))
+
+	log.Printf("INFO: HTTP server listening on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Fatalf("ERROR: %v", err)
+	}
+}
+
+// requireToken wraps the handler, rejecting requests without the expected bearer token
+func requireToken(token string, next http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		received := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(received), []byte(token)) != 1 {
+			http.Error(rw, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(rw, r)
+	}
+}
+
+// allowMethod wraps the handler, rejecting requests with another method
+func allowMethod(method string, next http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		next(rw, r)
+	}
+}
+
+// writeJSON sends v as the JSON response body
+func writeJSON(rw http.ResponseWriter, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(v); err != nil {
+		log.Printf("ERROR: can't write response: %v", err)
+	}
+}
+
+// handleRefresh executes an immediate cycle without cleanup, waiting for any running cycle to finish first.
+// With a shared refresh, the requests arriving while a refresh runs get its counts without starting another cycle.
+// POST /refresh
+func (w *worker) handleRefresh(rw http.ResponseWriter, r *http.Request) {
+	log.Printf("INFO: refresh requested")
+	var res cycleResult
+	var err error
+	if w.refresh != nil {
+		var shared bool
+		if res, shared, err = w.refresh.do(func() (cycleResult, error) { return w.runCycle(false) }); shared {
+			log.Printf("INFO: refresh shared with the one in flight")
+		}
+	} else {
+		res, err = w.runCycle(false)
+	}
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(rw, res)
+}
+
+// handleStats returns the aggregates of the stored circulars, cached for a short time.
+// GET /stats
+func (w *worker) handleStats(rw http.ResponseWriter, r *http.Request) {
+	stats, err := w.stats.get(w.readDB)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		http.Error(rw, "can't compute stats", http.StatusInternalServerError)
+		return
+	}
+
+	// The last cycle isn't cached, it doesn't need the DB
+	res := *stats
+	if lastCycle := w.lastCycleTime(); !lastCycle.IsZero() {
+		res.LastCycle = &lastCycle
+	}
+	writeJSON(rw, res)
+}
+
+// type health is the response of /health
+type health struct {
+	Status string `json:"status"`
+	// Breaker is the worst state among the breakers of the schools, Breakers the state of each one
+	Breaker   string            `json:"breaker"`
+	Breakers  map[string]string `json:"breakers"`
+	LastCycle *time.Time        `json:"last_cycle"`
+}
+
+// handleHealth reports whether the worker can fetch the circulars, it's degraded while a circuit breaker isn't closed.
+// GET /health
+func (w *worker) handleHealth(rw http.ResponseWriter, r *http.Request) {
+	res := health{Status: "ok", Breaker: w.breakers.worstState(), Breakers: w.breakers.states()}
+	if res.Breaker != breakerClosed {
+		res.Status = "degraded"
+	}
+	if lastCycle := w.lastCycleTime(); !lastCycle.IsZero() {
+		res.LastCycle = &lastCycle
+	}
+	writeJSON(rw, res)
+}
+
+// handleSearch returns the circulars matching the words of the query.
+// GET /search?q=<words>&limit=<n>
+func (w *worker) handleSearch(rw http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query().Get("q")
+	if strings.TrimSpace(q) == "" {
+		http.Error(rw, "missing q", http.StatusBadRequest)
+		return
+	}
+	limit, ok := queryLimit(rw, r, defaultSearchLimit)
+	if !ok {
+		return
+	}
+
+	results, err := searchCirculars(w.readDB, q, w.fulltextMinToken, limit)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		http.Error(rw, "can't search", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(rw, results)
+}
+
+// queryLimit returns the limit query parameter, def when it's missing.
+// When it's invalid the error is sent and ok is false
+func queryLimit(rw http.ResponseWriter, r *http.Request, def int) (limit int, ok bool) {
+	l := r.URL.Query().Get("limit")
+	if l == "" {
+		return def, true
+	}
+	n, err := strconv.Atoi(l)
+	if err != nil || n <= 0 {
+		http.Error(rw, "invalid limit", http.StatusBadRequest)
+		return 0, false
+	}
+	return n, true
+}
+
+// handleChanges returns the circulars added or changed after since, so clients can poll only for the deltas.
+// The next page starts from the changed_at and id of the last change
+// GET /circulars/changes?since=<rfc3339>&after_id=<id>&limit=<n>
+func (w *worker) handleChanges(rw http.ResponseWriter, r *http.Request) {
+	since, err := time.Parse(time.RFC3339, r.URL.Query().Get("since"))
+	if err != nil {
+		http.Error(rw, "since must be an RFC3339 time", http.StatusBadRequest)
+		return
+	}
+	var afterId uint64
+	if s := r.URL.Query().Get("after_id"); s != "" {
+		if afterId, err = strconv.ParseUint(s, 10, 64); err != nil {
+			http.Error(rw, "invalid after_id", http.StatusBadRequest)
+			return
+		}
+	}
+	limit, ok := queryLimit(rw, r, defaultChangesLimit)
+	if !ok {
+		return
+	}
+
+	changes, err := queryChanges(w.readDB, since, afterId, limit)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		http.Error(rw, "can't get the changes", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(rw, changes)
+}
+
+// latestCirculars returns the limit most recent circulars from the cache, or from the DB when it can't answer
+func (w *worker) latestCirculars(rw http.ResponseWriter, limit int) ([]latestCircular, error) {
+	if latest, ok := w.cache.latest(limit); ok {
+		rw.Header().Set("X-Cache", "hit")
+		return latest, nil
+	}
+	rw.Header().Set("X-Cache", "miss")
+	return queryLatest(w.readDB, limit)
+}
+
+// handleLatest returns the most recent circulars.
+// GET /circulars?limit=<n>
+func (w *worker) handleLatest(rw http.ResponseWriter, r *http.Request) {
+	limit, ok := queryLimit(rw, r, defaultLatestLimit)
+	if !ok {
+		return
+	}
+	latest, err := w.latestCirculars(rw, limit)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		http.Error(rw, "can't get the circulars", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(rw, latest)
+}
+
+// handleCalendar returns the most recent circulars as an iCalendar feed.
+// GET /calendar.ics?limit=<n>
+func (w *worker) handleCalendar(rw http.ResponseWriter, r *http.Request) {
+	limit, ok := queryLimit(rw, r, defaultLatestLimit)
+	if !ok {
+		return
+	}
+	latest, err := w.latestCirculars(rw, limit)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		http.Error(rw, "can't get the circulars", http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	if err := writeCalendar(rw, latest, time.Now()); err != nil {
+		log.Printf("ERROR: can't write response: %v", err)
+	}
+}
+
+// handleFeed returns the most recent circulars as an RSS feed.
+// GET /feed?limit=<n>
+func (w *worker) handleFeed(rw http.ResponseWriter, r *http.Request) {
+	limit, ok := queryLimit(rw, r, defaultLatestLimit)
+	if !ok {
+		return
+	}
+	latest, err := w.latestCirculars(rw, limit)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		http.Error(rw, "can't get the circulars", http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+	rw.Write([]byte(xml.Header))
+	if err := xml.NewEncoder(rw).Encode(newRSSFeed(w.siteUrls[0], latest)); err != nil {
+		log.Printf("ERROR: can't write response: %v", err)
+	}
+}
+
+// handleActive returns the most recent circulars whose valid until date hasn't passed, in the local time zone.
+// GET /circulars/active?limit=<n>
+func (w *worker) handleActive(rw http.ResponseWriter, r *http.Request) {
+	limit, ok := queryLimit(rw, r, defaultLatestLimit)
+	if !ok {
+		return
+	}
+	active, err := queryActive(w.readDB, time.Now(), w.validUntilInclusive, limit)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		http.Error(rw, "can't get the circulars", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(rw, active)
+}
+
+// proxiedHeaders are the headers of the attachment response sent to the client
+var proxiedHeaders = []string{"Content-Type", "Content-Length", "Content-Disposition", "Last-Modified"}
+
+// handleAttachment streams the file of a stored attachment, fetched with the client of the worker,
+// so a frontend can serve it without reaching the "segreteria digitale" itself.
+// GET /attachments/<id>
+func (w *worker) handleAttachment(rw http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/attachments/"), 10, 64)
+	if err != nil {
+		http.Error(rw, "invalid attachment id", http.StatusBadRequest)
+		return
+	}
+	u, err := storedAttachmentUrl(w.readDB, id)
+	if err == sql.ErrNoRows {
+		http.Error(rw, "attachment not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		http.Error(rw, "can't get the attachment", http.StatusInternalServerError)
+		return
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, u, nil)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		http.Error(rw, "can't get the attachment", http.StatusInternalServerError)
+		return
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		log.Printf("ERROR: attachment %d: %v", id, err)
+		http.Error(rw, "can't get the attachment", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		log.Printf("ERROR: attachment %d: status %s", id, resp.Status)
+		http.Error(rw, "can't get the attachment", http.StatusBadGateway)
+		return
+	}
+
+	// Streamed as it's received, the files can be large
+	for _, h := range proxiedHeaders {
+		if v := resp.Header.Get(h); v != "" {
+			rw.Header().Set(h, v)
+		}
+	}
+	if _, err := io.Copy(rw, resp.Body); err != nil {
+		log.Printf("ERROR: attachment %d: %v", id, err)
+	}
+}
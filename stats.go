@@ -0,0 +1,82 @@
+package main
+
+import (
+	"database/sql"
+	"sync"
+	"time"
+)
+
+// type dbStats contains the aggregates returned by /stats
+type dbStats struct {
+	Circulars   int            `json:"circulars"`
+	Attachments int            `json:"attachments"`
+	Categories  map[string]int `json:"categories"`
+	// Oldest and Newest are the published dates (yyyy-mm-dd), empty when unknown
+	Oldest    string     `json:"oldest"`
+	Newest    string     `json:"newest"`
+	LastCycle *time.Time `json:"last_cycle"`
+}
+
+// queryStats computes the aggregates of the stored circulars, without the ones hidden by an operator
+func queryStats(db *sql.DB) (*dbStats, error) {
+	col := columns
+	stats := &dbStats{Categories: make(map[string]int)}
+	shown := " WHERE `" + col.deletedAt + "` IS NULL"
+
+	var oldest, newest sql.NullString
+	published := "`" + col.publishedDate + "`"
+	if err := db.QueryRow("SELECT COUNT(*), MIN("+published+"), MAX("+published+") FROM circolare"+shown).Scan(&stats.Circulars, &oldest, &newest); err != nil {
+		return nil, err
+	}
+	stats.Oldest = oldest.String
+	stats.Newest = newest.String
+
+	if err := db.QueryRow("SELECT COUNT(*) FROM circolare_allegato a JOIN circolare c ON c.`" + col.id + "` = a.`" + col.attachmentCircularId + "` WHERE c.`" + col.deletedAt + "` IS NULL").Scan(&stats.Attachments); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("SELECT `" + col.category + "`, COUNT(*) FROM circolare" + shown + " GROUP BY `" + col.category + "`")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var category string
+		var count int
+		if err := rows.Scan(&category, &count); err != nil {
+			return nil, err
+		}
+		stats.Categories[category] = count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+// type statsCache keeps the last computed stats for ttl, so the endpoint doesn't hit the DB on every request
+type statsCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	expires time.Time
+	stats   *dbStats
+}
+
+// get returns the cached stats, querying them again when they're expired
+func (c *statsCache) get(db *sql.DB) (*dbStats, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.stats != nil && time.Now().Before(c.expires) {
+		return c.stats, nil
+	}
+
+	stats, err := queryStats(db)
+	if err != nil {
+		return nil, err
+	}
+	c.stats = stats
+	c.expires = time.Now().Add(c.ttl)
+	return stats, nil
+}
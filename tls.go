@@ -0,0 +1,57 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	"log"
+)
+
+// dbTLSConfigName is the name the TLS config of the DB connection is registered with
+const dbTLSConfigName = "circulars"
+
+// tlsVersions are the accepted values of CIRCULARS_TLS_MIN_VERSION
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// newTLSConfig returns the TLS config shared by the HTTP and the DB clients.
+// Disabling the verification is an escape hatch for self-signed certificates, it's logged loudly as it allows MITM attacks
+func newTLSConfig(minVersion string, insecureSkipVerify bool) (*tls.Config, error) {
+	version, exists := tlsVersions[minVersion]
+	if !exists {
+		return nil, fmt.Errorf("unknown TLS version %q, use 1.0, 1.1, 1.2 or 1.3", minVersion)
+	}
+	if version < tls.VersionTLS12 {
+		log.Printf("WARNING: accepting TLS %s, versions before 1.2 are insecure", minVersion)
+	}
+	if insecureSkipVerify {
+		log.Printf("WARNING: !!! TLS CERTIFICATE VERIFICATION IS DISABLED for the HTTP and DB connections, unset CIRCULARS_TLS_INSECURE_SKIP_VERIFY as soon as possible !!!")
+	}
+	return &tls.Config{MinVersion: version, InsecureSkipVerify: insecureSkipVerify}, nil
+}
+
+// configureDBTLS returns the connection string using cfg, when it requires TLS with 'tls=true' or 'tls=skip-verify'.
+// Connections without TLS, or with the opportunistic 'tls=preferred', are left untouched, and an explicit 'tls=skip-verify' is kept
+func configureDBTLS(dsn string, cfg *tls.Config) (string, error) {
+	dbCfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return "", err
+	}
+	if dbCfg.TLSConfig != "true" && dbCfg.TLSConfig != "skip-verify" {
+		return dsn, nil
+	}
+
+	dbTLS := cfg.Clone()
+	if dbCfg.TLSConfig == "skip-verify" {
+		dbTLS.InsecureSkipVerify = true
+	}
+	if err := mysql.RegisterTLSConfig(dbTLSConfigName, dbTLS); err != nil {
+		return "", err
+	}
+	dbCfg.TLSConfig = dbTLSConfigName
+	return dbCfg.FormatDSN(), nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// type transformer changes the parsed circulars before they're inserted in the DB.
+// It can edit, add or remove circulars, the returned slice replaces the received one
+type transformer func(circulars []circular) []circular
+
+// applyTransformers applies in order all the transformers to the circulars
+func applyTransformers(circulars []circular, transformers []transformer) []circular {
+	for _, t := range transformers {
+		circulars = t(circulars)
+	}
+	return circulars
+}
+
+// publishedDateFilter keeps only the circulars published between minDate and maxDate, both inclusive.
+// A zero minDate or maxDate leaves that side of the range unbounded.
+// Circulars without a parsed published date are always kept
+func publishedDateFilter(minDate, maxDate time.Time) transformer {
+	return func(circulars []circular) []circular {
+		var filtered []circular
+		for _, c := range circulars {
+			if c.PublishedDate.IsZero() {
+				filtered = append(filtered, c)
+				continue
+			}
+			if !minDate.IsZero() && c.PublishedDate.Before(minDate) {
+				continue
+			}
+			if !maxDate.IsZero() && c.PublishedDate.After(maxDate) {
+				continue
+			}
+			filtered = append(filtered, c)
+		}
+		return filtered
+	}
+}
+
+// minIdFilter keeps only the circulars whose id isn't smaller than minId
+func minIdFilter(minId uint64) transformer {
+	return func(circulars []circular) []circular {
+		var filtered []circular
+		for _, c := range circulars {
+			if c.Id >= minId {
+				filtered = append(filtered, c)
+			}
+		}
+		return filtered
+	}
+}
+
+// normalizeWhitespace trims and collapses repeated whitespace in titles, categories and attachments titles
+func normalizeWhitespace(circulars []circular) []circular {
+	for i := range circulars {
+		c := &circulars[i]
+		c.Title = strings.Join(strings.Fields(c.Title), " ")
+		c.Category = strings.Join(strings.Fields(c.Category), " ")
+		for j := range c.Attachments {
+			c.Attachments[j].Title = strings.Join(strings.Fields(c.Attachments[j].Title), " ")
+		}
+	}
+	return circulars
+}
+
+// categoryFilter keeps only the circulars whose category is one of categories, compared case insensitively
+func categoryFilter(categories []string) transformer {
+	allowed := make(map[string]bool, len(categories))
+	for _, c := range categories {
+		allowed[strings.ToLower(strings.TrimSpace(c))] = true
+	}
+
+	return func(circulars []circular) []circular {
+		var filtered []circular
+		for _, c := range circulars {
+			if allowed[strings.ToLower(strings.TrimSpace(c.Category))] {
+				filtered = append(filtered, c)
+			}
+		}
+		return filtered
+	}
+}
+
+// categoryKey is how categories are compared by categoryNormalizer, lowercase and with the whitespace collapsed
+func categoryKey(category string) string {
+	return strings.ToLower(strings.Join(strings.Fields(category), " "))
+}
+
+// parseCategoryMap returns the canonical category of each category key, from a comma separated list of category=canonical,
+// e.g. "didattica=Didattica,comunicazioni=Generale"
+func parseCategoryMap(s string) (map[string]string, error) {
+	m := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("%q isn't category=canonical", pair)
+		}
+		category, canonical := categoryKey(kv[0]), strings.Join(strings.Fields(kv[1]), " ")
+		if category == "" || canonical == "" {
+			return nil, fmt.Errorf("%q has an empty category", pair)
+		}
+		m[category] = canonical
+	}
+	return m, nil
+}
+
+// titleCase uppercases the first letter of each word and lowercases the others, e.g. "DIDATTICA generale" -> "Didattica Generale"
+func titleCase(s string) string {
+	words := strings.Fields(s)
+	for i, w := range words {
+		r := []rune(strings.ToLower(w))
+		r[0] = unicode.ToUpper(r[0])
+		words[i] = string(r)
+	}
+	return strings.Join(words, " ")
+}
+
+// canonicalCategory returns the canonical name of the category from mapping, compared as categoryKey.
+// An unmapped category is kept, title cased when titleCased is set
+func canonicalCategory(category string, mapping map[string]string, titleCased bool) string {
+	if canonical, exists := mapping[categoryKey(category)]; exists {
+		return canonical
+	}
+	if titleCased {
+		return titleCase(category)
+	}
+	return category
+}
+
+// categoryNormalizer replaces the category of each circular with its canonical name, see canonicalCategory
+func categoryNormalizer(mapping map[string]string, titleCased bool) transformer {
+	return func(circulars []circular) []circular {
+		for i := range circulars {
+			circulars[i].Category = canonicalCategory(circulars[i].Category, mapping, titleCased)
+		}
+		return circulars
+	}
+}
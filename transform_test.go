@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestCanonicalCategory(t *testing.T) {
+	mapping, err := parseCategoryMap("didattica=Didattica, comunicazioni  generali = Generale")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		category, expected string
+	}{
+		{"Didattica", "Didattica"},
+		{"DIDATTICA", "Didattica"},
+		{"Didattica ", "Didattica"},
+		{"Comunicazioni Generali", "Generale"},
+		// Unmapped, title cased
+		{"uscite DIDATTICHE", "Uscite Didattiche"},
+	}
+	for _, tt := range tests {
+		if got := canonicalCategory(tt.category, mapping, true); got != tt.expected {
+			t.Errorf("canonical category of %q is %q, expected %q", tt.category, got, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,16 @@
+package main
+
+import "fmt"
+
+// Build info, set at build time with:
+// go build -ldflags "-X main.version=1.2.3 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%FT%TZ)"
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+// versionString returns the build info in a single line
+func versionString() string {
+	return fmt.Sprintf("circolari %s (commit %s, built %s)", version, commit, buildDate)
+}